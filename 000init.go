@@ -1,21 +1,124 @@
 package pex
 
-// This file is deliberately named like this so that it's first compiled and
-// first executed because it performs version checks to make sure these
-// bindings are compatible with the native library.
+// This file is deliberately named like this so that it's first compiled. It
+// holds the version of these bindings and the checks making sure that they
+// are compatible with the native library. The checks are performed lazily,
+// when the first client is created, so that merely importing this package
+// never fails.
 
 // #cgo pkg-config: pexsdk
 // #cgo LDFLAGS: -Wl,-rpath,/usr/local/lib
 //
-// #define PEX_SDK_MAJOR_VERSION 4
-// #define PEX_SDK_MINOR_VERSION 5
-//
 // #include <pex/sdk/version.h>
 import "C"
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+const (
+	bindingsMajorVersion = 4
+	bindingsMinorVersion = 5
+)
+
+type apiVersion struct {
+	major, minor int
+}
+
+func (x apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", x.major, x.minor)
+}
+
+// knownVersions lists the versions of the native library API known to these
+// bindings, newest first. Only these are probed when determining NativeAPI.
+var knownVersions = []apiVersion{
+	{4, 5},
+	{4, 4},
+	{4, 3},
+	{4, 2},
+	{4, 1},
+	{4, 0},
+}
+
+// ErrIncompatibleNativeLibrary is returned when creating a client if the
+// installed native library is not compatible with these bindings.
+var ErrIncompatibleNativeLibrary = errors.New("bindings are not compatible with the native library")
+
+// VersionInfo is returned by Version.
+type VersionInfo struct {
+	// Bindings is the version of these bindings, e.g. "4.5".
+	Bindings string
+
+	// NativeAPI is the newest version of the native library API known to
+	// these bindings that the installed library reports as compatible, or an
+	// empty string if it reports none of them. It's not the version of the
+	// library itself, which the library doesn't report: it's determined by
+	// probing Pex_Version_IsCompatible, so a newer library is reported as
+	// the newest version known to these bindings.
+	NativeAPI string
+
+	// Compatible reports whether the native library is compatible with
+	// these bindings. Clients can only be created if it is.
+	Compatible bool
+
+	// FFmpeg is the path to the ffmpeg binary found in the directories
+	// listed in the PATH environment variable, or an empty string if there's
+	// none. ffmpeg is an external dependency, which is only required to
+	// fingerprint time ranges of media (see FingerprintOptions) and thus by
+	// LongFormSearcher. Clients can use a binary installed elsewhere, see
+	// WithFFmpegPath.
+	FFmpeg string
+}
+
+var version struct {
+	once sync.Once
+	info VersionInfo
+}
+
+// Version reports the version of these bindings and the version of the native
+// library API they can use. It's meant to be logged or checked at startup.
+func Version() VersionInfo {
+	version.once.Do(func() {
+		version.info = probeVersion()
+	})
+	return version.info
+}
+
+func probeVersion() VersionInfo {
+	info := VersionInfo{
+		Bindings:   apiVersion{bindingsMajorVersion, bindingsMinorVersion}.String(),
+		Compatible: isCompatible(bindingsMajorVersion, bindingsMinorVersion),
+	}
+
+	for _, v := range knownVersions {
+		if !isCompatible(v.major, v.minor) {
+			continue
+		}
+		info.NativeAPI = v.String()
+		break
+	}
+
+	info.FFmpeg, _ = exec.LookPath("ffmpeg")
+	return info
+}
+
+func isCompatible(major, minor int) bool {
+	return bool(C.Pex_Version_IsCompatible(C.int(major), C.int(minor)))
+}
+
+// checkCompatibility returns ErrIncompatibleNativeLibrary if the native
+// library is not compatible with these bindings.
+func checkCompatibility() error {
+	info := Version()
+	if info.Compatible {
+		return nil
+	}
 
-func init() {
-	compatible := C.Pex_Version_IsCompatible(C.PEX_SDK_MAJOR_VERSION, C.PEX_SDK_MINOR_VERSION)
-	if !compatible {
-		panic("bindings are not compatible with the native library")
+	native := info.NativeAPI
+	if native == "" {
+		native = "unknown"
 	}
+	return fmt.Errorf("%w: bindings version %s, native library API version %s", ErrIncompatibleNativeLibrary, info.Bindings, native)
 }
@@ -0,0 +1,112 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+// #include <pex/sdk/status.h>
+// #include <pex/sdk/client.h>
+// #include <pex/sdk/fingerprint.h>
+// #include <pex/sdk/search.h>
+// #include <pex/sdk/ingestion.h>
+import "C"
+import "unsafe"
+
+// allocator allocates native objects and keeps track of them, so that they
+// can all be freed at once, typically using:
+//
+//	var a allocator
+//	defer a.free()
+//
+// An allocation failure is reported as an error with StatusOutOfMemory.
+type allocator struct {
+	frees []func()
+}
+
+// free deletes all the objects in the reverse order of their allocation.
+func (a *allocator) free() {
+	for i := len(a.frees) - 1; i >= 0; i-- {
+		a.frees[i]()
+	}
+	a.frees = nil
+}
+
+func errOutOfMemory(what string) error {
+	return &Error{
+		Code:    StatusOutOfMemory,
+		Message: "out of memory: failed to allocate " + what,
+	}
+}
+
+// allocate is generic over the pointer types, since incomplete C types
+// can't be used as type arguments.
+func allocate[P comparable](a *allocator, what string, newFn func() P, deleteFn func(*P)) (P, error) {
+	var null P
+	p := newFn()
+	if p == null {
+		return null, errOutOfMemory(what)
+	}
+	a.frees = append(a.frees, func() {
+		deleteFn(&p)
+	})
+	return p, nil
+}
+
+func (a *allocator) status() (*C.Pex_Status, error) {
+	return allocate(a, "status",
+		func() *C.Pex_Status { return C.Pex_Status_New() },
+		func(p **C.Pex_Status) { C.Pex_Status_Delete(p) })
+}
+
+func (a *allocator) buffer() (*C.Pex_Buffer, error) {
+	return allocate(a, "buffer",
+		func() *C.Pex_Buffer { return C.Pex_Buffer_New() },
+		func(p **C.Pex_Buffer) { C.Pex_Buffer_Delete(p) })
+}
+
+func (a *allocator) startSearchRequest() (*C.Pex_StartSearchRequest, error) {
+	return allocate(a, "start search request",
+		func() *C.Pex_StartSearchRequest { return C.Pex_StartSearchRequest_New() },
+		func(p **C.Pex_StartSearchRequest) { C.Pex_StartSearchRequest_Delete(p) })
+}
+
+func (a *allocator) startSearchResult() (*C.Pex_StartSearchResult, error) {
+	return allocate(a, "start search result",
+		func() *C.Pex_StartSearchResult { return C.Pex_StartSearchResult_New() },
+		func(p **C.Pex_StartSearchResult) { C.Pex_StartSearchResult_Delete(p) })
+}
+
+func (a *allocator) checkSearchRequest() (*C.Pex_CheckSearchRequest, error) {
+	return allocate(a, "check search request",
+		func() *C.Pex_CheckSearchRequest { return C.Pex_CheckSearchRequest_New() },
+		func(p **C.Pex_CheckSearchRequest) { C.Pex_CheckSearchRequest_Delete(p) })
+}
+
+func (a *allocator) checkSearchResult() (*C.Pex_CheckSearchResult, error) {
+	return allocate(a, "check search result",
+		func() *C.Pex_CheckSearchResult { return C.Pex_CheckSearchResult_New() },
+		func(p **C.Pex_CheckSearchResult) { C.Pex_CheckSearchResult_Delete(p) })
+}
+
+func (a *allocator) listRequest() (*C.Pex_ListRequest, error) {
+	return allocate(a, "list request",
+		func() *C.Pex_ListRequest { return C.Pex_ListRequest_New() },
+		func(p **C.Pex_ListRequest) { C.Pex_ListRequest_Delete(p) })
+}
+
+func (a *allocator) listResult() (*C.Pex_ListResult, error) {
+	return allocate(a, "list result",
+		func() *C.Pex_ListResult { return C.Pex_ListResult_New() },
+		func(p **C.Pex_ListResult) { C.Pex_ListResult_Delete(p) })
+}
+
+// bufferFrom allocates a buffer pointing to the given data. The data must
+// stay alive and unmodified until the buffer is freed.
+func (a *allocator) bufferFrom(data []byte) (*C.Pex_Buffer, error) {
+	buf, err := a.buffer()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		C.Pex_Buffer_Set(buf, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	}
+	return buf, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultSearchManyConcurrency is the default maximum number of searches
+// performed concurrently by SearchMany.
+const DefaultSearchManyConcurrency = 16
+
+// SearchManyOptions configure SearchMany and SearchManyStream.
+type SearchManyOptions struct {
+	// Concurrency is the maximum number of searches that are started but not
+	// finished yet. It defaults to DefaultSearchManyConcurrency.
+	Concurrency int
+
+	// Progress, if set, is called after every finished search. Calls are
+	// serialized.
+	Progress func(SearchManyProgress)
+}
+
+// SearchManyProgress is passed to SearchManyOptions.Progress.
+type SearchManyProgress struct {
+	Done    int
+	Failed  int
+	Total   int
+	Elapsed time.Duration
+}
+
+// SearchManyResult is the outcome of a single search performed by
+// SearchMany, with T being *PexSearchResult or *PrivateSearchResult.
+type SearchManyResult[T any] struct {
+	// Index is the position of the request in the slice passed to
+	// SearchMany.
+	Index int
+
+	Result T
+	Err    error
+}
+
+// SearchMany performs the searches and waits for all of them to finish.
+// The results are returned in the order of the requests. A failed search
+// doesn't affect the others, its error is returned in the corresponding
+// SearchManyResult. If the context is done, the remaining searches fail
+// with the context error.
+//
+// The searches are pipelined: new searches are started while the results
+// of the previous ones are being retrieved, up to the concurrency limit.
+func (x *PexSearchClient) SearchMany(ctx context.Context, reqs []*PexSearchRequest, opts *SearchManyOptions) []SearchManyResult[*PexSearchResult] {
+	return collectSearchMany(x.SearchManyStream(ctx, reqs, opts), len(reqs))
+}
+
+// SearchManyStream is like SearchMany, but sends the results to the
+// returned channel as soon as the individual searches finish. The channel
+// is closed after the last result. It's buffered, so it doesn't need to be
+// drained.
+func (x *PexSearchClient) SearchManyStream(ctx context.Context, reqs []*PexSearchRequest, opts *SearchManyOptions) <-chan SearchManyResult[*PexSearchResult] {
+	return searchMany(ctx, reqs, opts, func(ctx context.Context, req *PexSearchRequest) (SearchFuture[*PexSearchResult], error) {
+		fut, err := x.StartSearchContext(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return fut, nil
+	})
+}
+
+// SearchMany is like PexSearchClient.SearchMany, but performs private
+// searches.
+func (x *PrivateSearchClient) SearchMany(ctx context.Context, reqs []*PrivateSearchRequest, opts *SearchManyOptions) []SearchManyResult[*PrivateSearchResult] {
+	return collectSearchMany(x.SearchManyStream(ctx, reqs, opts), len(reqs))
+}
+
+// SearchManyStream is like PexSearchClient.SearchManyStream, but performs
+// private searches.
+func (x *PrivateSearchClient) SearchManyStream(ctx context.Context, reqs []*PrivateSearchRequest, opts *SearchManyOptions) <-chan SearchManyResult[*PrivateSearchResult] {
+	return searchMany(ctx, reqs, opts, func(ctx context.Context, req *PrivateSearchRequest) (SearchFuture[*PrivateSearchResult], error) {
+		fut, err := x.StartSearchContext(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return fut, nil
+	})
+}
+
+func collectSearchMany[T any](ch <-chan SearchManyResult[T], n int) []SearchManyResult[T] {
+	out := make([]SearchManyResult[T], n)
+	for res := range ch {
+		out[res.Index] = res
+	}
+	return out
+}
+
+func searchMany[Req, Res any](ctx context.Context, reqs []Req, opts *SearchManyOptions, start func(context.Context, Req) (SearchFuture[Res], error)) <-chan SearchManyResult[Res] {
+	if opts == nil {
+		opts = new(SearchManyOptions)
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultSearchManyConcurrency
+	}
+
+	out := make(chan SearchManyResult[Res], len(reqs))
+
+	begin := time.Now()
+	progress := SearchManyProgress{Total: len(reqs)}
+
+	var mu sync.Mutex
+	report := func(res SearchManyResult[Res]) {
+		mu.Lock()
+		progress.Done++
+		if res.Err != nil {
+			progress.Failed++
+		}
+		progress.Elapsed = time.Since(begin)
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		mu.Unlock()
+
+		out <- res
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+
+		for i, req := range reqs {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				report(SearchManyResult[Res]{Index: i, Err: ctx.Err()})
+				continue
+			}
+
+			fut, err := start(ctx, req)
+			if err != nil {
+				<-sem
+				report(SearchManyResult[Res]{Index: i, Err: err})
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int, fut SearchFuture[Res]) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				defer fut.Cancel()
+
+				res, err := fut.GetContext(ctx)
+				report(SearchManyResult[Res]{Index: i, Result: res, Err: err})
+			}(i, fut)
+		}
+
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testFuture struct {
+	*future[int]
+}
+
+func (x testFuture) Get() (int, error) {
+	return x.GetContext(context.Background())
+}
+
+// startTestSearch returns a start function for searchMany. The search of a
+// request takes as many milliseconds as the request's value and returns the
+// value times 10, unless the request is in startErrs or searchErrs.
+func startTestSearch(startErrs, searchErrs map[int]error) func(context.Context, int) (SearchFuture[int], error) {
+	return func(ctx context.Context, req int) (SearchFuture[int], error) {
+		if err := startErrs[req]; err != nil {
+			return nil, err
+		}
+		return testFuture{newFuture(func(ctx context.Context) (int, error) {
+			if err := sleepContext(ctx, time.Duration(req)*time.Millisecond); err != nil {
+				return 0, err
+			}
+			if err := searchErrs[req]; err != nil {
+				return 0, err
+			}
+			return req * 10, nil
+		}, testPollPolicy)}, nil
+	}
+}
+
+func TestSearchMany(t *testing.T) {
+	startErr := errors.New("start failed")
+	searchErr := errors.New("search failed")
+
+	// The later requests finish first.
+	reqs := []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+
+	var last SearchManyProgress
+	opts := &SearchManyOptions{
+		Concurrency: 3,
+		Progress:    func(p SearchManyProgress) { last = p },
+	}
+	start := startTestSearch(map[int]error{3: startErr}, map[int]error{5: searchErr})
+
+	got := collectSearchMany(searchMany(context.Background(), reqs, opts, start), len(reqs))
+
+	for i, res := range got {
+		req := reqs[i]
+		var wantErr error
+		switch req {
+		case 3:
+			wantErr = startErr
+		case 5:
+			wantErr = searchErr
+		}
+
+		if res.Index != i {
+			t.Errorf("result %d: got index %d", i, res.Index)
+		}
+		if res.Err != wantErr {
+			t.Errorf("result %d: got error %v, want %v", i, res.Err, wantErr)
+		}
+		if wantErr == nil && res.Result != req*10 {
+			t.Errorf("result %d: got %d, want %d", i, res.Result, req*10)
+		}
+	}
+
+	if last.Done != len(reqs) || last.Failed != 2 || last.Total != len(reqs) {
+		t.Errorf("last progress = %+v, want %d done, 2 failed", last, len(reqs))
+	}
+}
+
+func TestSearchManyConcurrency(t *testing.T) {
+	const concurrency = 4
+
+	var mu sync.Mutex
+	var active, peak int
+	start := func(ctx context.Context, req int) (SearchFuture[int], error) {
+		mu.Lock()
+		if active++; active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		return testFuture{newFuture(func(ctx context.Context) (int, error) {
+			defer func() {
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}()
+			time.Sleep(time.Millisecond)
+			return req, nil
+		}, testPollPolicy)}, nil
+	}
+
+	reqs := make([]int, 32)
+	opts := &SearchManyOptions{Concurrency: concurrency}
+	for range searchMany(context.Background(), reqs, opts, start) {
+	}
+
+	if peak > concurrency {
+		t.Errorf("got %d concurrent searches, want at most %d", peak, concurrency)
+	}
+}
+
+func TestSearchManyCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	started := make(chan struct{}, 4)
+	start := func(ctx context.Context, req int) (SearchFuture[int], error) {
+		return testFuture{newFuture(func(ctx context.Context) (int, error) {
+			if req == 0 {
+				return 0, nil
+			}
+			started <- struct{}{}
+			select {
+			case <-block:
+			case <-ctx.Done():
+			}
+			return 0, ctx.Err()
+		}, testPollPolicy)}, nil
+	}
+
+	// The first request finishes, the next two block and the rest can't
+	// start until they finish.
+	reqs := []int{0, 1, 2, 3, 4}
+	ch := searchMany(ctx, reqs, &SearchManyOptions{Concurrency: 2}, start)
+	if res := <-ch; res.Index != 0 || res.Err != nil {
+		t.Fatalf("first result = %+v, want a successful search", res)
+	}
+	<-started
+	<-started
+	cancel()
+
+	got := collectSearchMany(ch, len(reqs))
+	for i, res := range got[1:] {
+		if !errors.Is(res.Err, context.Canceled) {
+			t.Errorf("result %d: got error %v, want %v", i+1, res.Err, context.Canceled)
+		}
+	}
+}
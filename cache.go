@@ -0,0 +1,443 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FingerprintStore is the storage behind a FingerprintCache. The keys are
+// opaque strings consisting of letters and digits. Implementations must be
+// safe for concurrent use.
+type FingerprintStore interface {
+	// Get returns the fingerprint stored under the key, or nil if there's
+	// none.
+	Get(key string) (*Fingerprint, error)
+
+	// Put stores the fingerprint under the key. The store may evict other
+	// fingerprints to make room for it, or ignore it altogether.
+	Put(key string, ft *Fingerprint) error
+}
+
+// FingerprintCache caches fingerprints created by the clients, so that the
+// same media doesn't need to be fingerprinted again. The fingerprints are
+// keyed by the SHA-256 hash of the media, the requested types and the
+// version of the bindings. A cache can be shared by multiple clients, see
+// WithFingerprintCache.
+//
+// The cache is best-effort: errors of the store are logged and treated as
+// cache misses. Concurrent requests for the same fingerprint are coalesced,
+// the media is fingerprinted only once and the other requests wait for the
+// result.
+type FingerprintCache struct {
+	store FingerprintStore
+
+	mu       sync.Mutex
+	inflight map[string]*cacheCall
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	errors atomic.Int64
+}
+
+// FingerprintCacheStats are returned by FingerprintCache.Stats.
+type FingerprintCacheStats struct {
+	// Hits counts the fingerprints found in the store or created by a
+	// concurrent request.
+	Hits   int64
+	Misses int64
+
+	// Errors counts the failed operations of the store.
+	Errors int64
+}
+
+// NewFingerprintCache creates a cache backed by the given store.
+func NewFingerprintCache(store FingerprintStore) *FingerprintCache {
+	return &FingerprintCache{
+		store:    store,
+		inflight: make(map[string]*cacheCall),
+	}
+}
+
+// cacheCall is a creation of a fingerprint in progress.
+type cacheCall struct {
+	done chan struct{}
+	ft   *Fingerprint // nil if the creation failed
+}
+
+// WithFingerprintCache makes the client look up the fingerprints created by
+// the FingerprintFile and FingerprintBuffer methods (and the methods built
+// on top of them) in the cache before fingerprinting the media, and store
+// them in the cache afterwards. The cache requires the media to be hashed
+// first, which is cheap compared to fingerprinting it.
+func WithFingerprintCache(cache *FingerprintCache) Option {
+	return func(o *options) {
+		o.cache = cache
+	}
+}
+
+// Stats returns the statistics of the cache collected since it was created.
+func (x *FingerprintCache) Stats() FingerprintCacheStats {
+	return FingerprintCacheStats{
+		Hits:   x.hits.Load(),
+		Misses: x.misses.Load(),
+		Errors: x.errors.Load(),
+	}
+}
+
+// getOrCreate returns the cached fingerprint described by meta, or creates
+// it using fn and caches it. It just calls fn if the cache is nil.
+func (x *FingerprintCache) getOrCreate(meta FingerprintMetadata, logf func(string, ...any), fn func() (*Fingerprint, error)) (*Fingerprint, error) {
+	if x == nil {
+		return fn()
+	}
+
+	key := fingerprintCacheKey(meta)
+
+	for {
+		x.mu.Lock()
+		c, ok := x.inflight[key]
+		if !ok {
+			c = &cacheCall{done: make(chan struct{})}
+			x.inflight[key] = c
+		}
+		x.mu.Unlock()
+
+		if !ok {
+			return x.create(key, c, logf, fn)
+		}
+
+		<-c.done
+		if c.ft != nil {
+			x.hits.Add(1)
+			ft := *c.ft
+			return &ft, nil
+		}
+		// The error may be specific to the other request, e.g. its context
+		// may have been canceled, so try again.
+	}
+}
+
+// create looks up the fingerprint in the store, or creates it using fn and
+// stores it. The result is shared with the requests waiting for c.
+func (x *FingerprintCache) create(key string, c *cacheCall, logf func(string, ...any), fn func() (*Fingerprint, error)) (*Fingerprint, error) {
+	defer func() {
+		x.mu.Lock()
+		delete(x.inflight, key)
+		x.mu.Unlock()
+		close(c.done)
+	}()
+
+	ft, err := x.store.Get(key)
+	if err != nil {
+		x.errors.Add(1)
+		logf("failed to read fingerprint %s from cache: %v", key, err)
+	}
+	if ft != nil {
+		x.hits.Add(1)
+		c.share(ft)
+		return ft, nil
+	}
+	x.misses.Add(1)
+
+	ft, err = fn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := x.store.Put(key, ft); err != nil {
+		x.errors.Add(1)
+		logf("failed to write fingerprint %s to cache: %v", key, err)
+	}
+	c.share(ft)
+	return ft, nil
+}
+
+// share sets the result of the call to a copy of ft, so that the caller
+// can change the metadata of ft.
+func (x *cacheCall) share(ft *Fingerprint) {
+	shared := *ft
+	x.ft = &shared
+}
+
+func fingerprintCacheKey(meta FingerprintMetadata) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%s", meta.SourceSHA256, int(meta.Types), meta.SDKVersion)))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryFingerprintStore is a FingerprintStore keeping the fingerprints in
+// memory. When its size limit is reached, the least recently used
+// fingerprints are evicted.
+type MemoryFingerprintStore struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List // of *memoryEntry, most recently used first
+	index map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key string
+	ft  Fingerprint
+}
+
+// NewMemoryFingerprintStore creates a store that holds fingerprints of up to
+// maxBytes bytes in total.
+func NewMemoryFingerprintStore(maxBytes int64) *MemoryFingerprintStore {
+	return &MemoryFingerprintStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+// Get implements FingerprintStore. It returns a copy of the stored
+// fingerprint, so that changes of its metadata don't affect the store.
+func (x *MemoryFingerprintStore) Get(key string) (*Fingerprint, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	e, ok := x.index[key]
+	if !ok {
+		return nil, nil
+	}
+	x.lru.MoveToFront(e)
+
+	ft := e.Value.(*memoryEntry).ft
+	return &ft, nil
+}
+
+// Put implements FingerprintStore. Fingerprints larger than the size limit
+// are not stored.
+func (x *MemoryFingerprintStore) Put(key string, ft *Fingerprint) error {
+	size := int64(len(ft.b))
+	if size > x.maxBytes {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if e, ok := x.index[key]; ok {
+		x.remove(e)
+	}
+	for x.bytes+size > x.maxBytes {
+		x.remove(x.lru.Back())
+	}
+
+	x.index[key] = x.lru.PushFront(&memoryEntry{key: key, ft: *ft})
+	x.bytes += size
+	return nil
+}
+
+func (x *MemoryFingerprintStore) remove(e *list.Element) {
+	entry := x.lru.Remove(e).(*memoryEntry)
+	delete(x.index, entry.key)
+	x.bytes -= int64(len(entry.ft.b))
+}
+
+// Len returns the number of stored fingerprints.
+func (x *MemoryFingerprintStore) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.lru.Len()
+}
+
+// Size returns the total size of the stored fingerprints in bytes.
+func (x *MemoryFingerprintStore) Size() int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.bytes
+}
+
+const dirFingerprintStoreExt = ".pexfp"
+
+// DirFingerprintStore is a FingerprintStore keeping the fingerprints in
+// files in a directory, using the format written by Fingerprint.SaveFile.
+// When its size limit is reached, the least recently used fingerprints are
+// removed; the use is tracked by the modification times of the files.
+//
+// Multiple stores, even in different processes, may share a directory, but
+// the size limit is only enforced approximately in that case.
+type DirFingerprintStore struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+}
+
+// NewDirFingerprintStore creates a store that holds fingerprints of up to
+// maxBytes bytes in total in the given directory, which is created if it
+// doesn't exist.
+func NewDirFingerprintStore(dir string, maxBytes int64) (*DirFingerprintStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	x := &DirFingerprintStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+
+	files, err := x.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		x.bytes += f.size
+	}
+	return x, nil
+}
+
+// Get implements FingerprintStore. Files that can't be read are removed.
+func (x *DirFingerprintStore) Get(key string) (*Fingerprint, error) {
+	path, err := x.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ft, err := LoadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if errors.Is(err, ErrCorruptFingerprint) {
+		x.removeFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return ft, nil
+}
+
+// Put implements FingerprintStore. The fingerprint is written atomically,
+// see Fingerprint.SaveFile.
+func (x *DirFingerprintStore) Put(key string, ft *Fingerprint) error {
+	path, err := x.path(key)
+	if err != nil {
+		return err
+	}
+
+	x.removeFile(path)
+	if err := ft.SaveFile(path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	x.mu.Lock()
+	x.bytes += info.Size()
+	full := x.bytes > x.maxBytes
+	x.mu.Unlock()
+
+	if full {
+		return x.evict()
+	}
+	return nil
+}
+
+// Size returns the total size of the stored fingerprints in bytes.
+func (x *DirFingerprintStore) Size() int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.bytes
+}
+
+func (x *DirFingerprintStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\.`) {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
+	return filepath.Join(x.dir, key+dirFingerprintStoreExt), nil
+}
+
+func (x *DirFingerprintStore) removeFile(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if os.Remove(path) == nil {
+		x.mu.Lock()
+		x.bytes -= info.Size()
+		x.mu.Unlock()
+	}
+}
+
+type storeFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (x *DirFingerprintStore) list() ([]storeFile, error) {
+	entries, err := os.ReadDir(x.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []storeFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() || filepath.Ext(e.Name()) != dirFingerprintStoreExt {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed in the meantime
+		}
+		files = append(files, storeFile{
+			path:    filepath.Join(x.dir, e.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+// evict removes the least recently used files until the store fits into its
+// size limit. The size is recomputed from the directory, which corrects any
+// drift caused by other stores using it.
+func (x *DirFingerprintStore) evict() error {
+	files, err := x.list()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	for _, f := range files {
+		if total <= x.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			total -= f.size
+		}
+	}
+
+	x.mu.Lock()
+	x.bytes = total
+	x.mu.Unlock()
+	return nil
+}
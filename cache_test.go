@@ -0,0 +1,299 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestFingerprint(size int) *Fingerprint {
+	return &Fingerprint{b: make([]byte, size)}
+}
+
+func nopLogf(string, ...any) {}
+
+func TestMemoryFingerprintStore(t *testing.T) {
+	store := NewMemoryFingerprintStore(10)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Put(key, newTestFingerprint(4)); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+
+	// "a" was evicted to make room for "c".
+	if got, want := store.Len(), 2; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	if got, want := store.Size(), int64(8); got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+	if ft, _ := store.Get("a"); ft != nil {
+		t.Error("Get(\"a\"): got a fingerprint, want it evicted")
+	}
+
+	// Using "b" makes "c" the least recently used one.
+	if ft, _ := store.Get("b"); ft == nil {
+		t.Fatal("Get(\"b\"): got nil")
+	}
+	store.Put("d", newTestFingerprint(4))
+	if ft, _ := store.Get("c"); ft != nil {
+		t.Error("Get(\"c\"): got a fingerprint, want it evicted")
+	}
+	if ft, _ := store.Get("b"); ft == nil {
+		t.Error("Get(\"b\"): got nil, want it kept")
+	}
+
+	// Replacing a fingerprint doesn't count it twice.
+	store.Put("b", newTestFingerprint(2))
+	if got, want := store.Size(), int64(6); got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+
+	// Fingerprints larger than the limit are ignored.
+	store.Put("e", newTestFingerprint(11))
+	if ft, _ := store.Get("e"); ft != nil {
+		t.Error("Get(\"e\"): got a fingerprint larger than the limit")
+	}
+
+	// Changes of the returned metadata don't affect the store.
+	ft, _ := store.Get("b")
+	ft.Metadata.SourceSHA256 = "changed"
+	if ft, _ := store.Get("b"); ft.Metadata.SourceSHA256 != "" {
+		t.Errorf("stored metadata changed to %q", ft.Metadata.SourceSHA256)
+	}
+}
+
+func TestDirFingerprintStore(t *testing.T) {
+	dir := t.TempDir()
+
+	ft := newTestFingerprint(16)
+	ft.Metadata = FingerprintMetadata{Types: FingerprintTypeAudio, SourceSHA256: "abc"}
+	data, err := ft.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	size := int64(len(data))
+
+	store, err := NewDirFingerprintStore(dir, 2*size)
+	if err != nil {
+		t.Fatalf("NewDirFingerprintStore: %v", err)
+	}
+
+	if got, err := store.Get("missing"); got != nil || err != nil {
+		t.Errorf("Get(\"missing\") = %v, %v, want nil, nil", got, err)
+	}
+	if err := store.Put("../a", ft); err == nil {
+		t.Error("Put(\"../a\"): got no error")
+	}
+
+	if err := store.Put("a", ft); err != nil {
+		t.Fatalf("Put(\"a\"): %v", err)
+	}
+	got, err := store.Get("a")
+	if err != nil {
+		t.Fatalf("Get(\"a\"): %v", err)
+	}
+	if got.Metadata.SourceSHA256 != "abc" || len(got.Dump()) != 16 {
+		t.Errorf("Get(\"a\") = %+v, want the stored fingerprint", got)
+	}
+
+	// Make "a" the least recently used one, the modification times may
+	// have a coarse resolution.
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "a"+dirFingerprintStoreExt), old, old)
+
+	store.Put("b", ft)
+	store.Put("c", ft)
+	if got, _ := store.Get("a"); got != nil {
+		t.Error("Get(\"a\"): got a fingerprint, want it evicted")
+	}
+	if got, want := store.Size(), 2*size; got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+
+	// A new store picks up the existing files.
+	store, err = NewDirFingerprintStore(dir, 2*size)
+	if err != nil {
+		t.Fatalf("NewDirFingerprintStore: %v", err)
+	}
+	if got, want := store.Size(), 2*size; got != want {
+		t.Errorf("Size() of a reopened store = %d, want %d", got, want)
+	}
+
+	// Corrupt files are removed.
+	path := filepath.Join(dir, "b"+dirFingerprintStoreExt)
+	if err := os.WriteFile(path, data[:len(data)-1], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("b"); err == nil {
+		t.Error("Get(\"b\") of a corrupt file: got no error")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("corrupt file not removed: %v", err)
+	}
+}
+
+func TestFingerprintCache(t *testing.T) {
+	cache := NewFingerprintCache(NewMemoryFingerprintStore(1 << 20))
+	meta := FingerprintMetadata{Types: FingerprintTypeAudio, SourceSHA256: "abc"}
+
+	var created int
+	create := func() (*Fingerprint, error) {
+		created++
+		return newTestFingerprint(4), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.getOrCreate(meta, nopLogf, create); err != nil {
+			t.Fatalf("getOrCreate: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("created %d fingerprints, want 1", created)
+	}
+
+	// The key depends on the types.
+	meta.Types = FingerprintTypeMelody
+	cache.getOrCreate(meta, nopLogf, create)
+	if created != 2 {
+		t.Errorf("created %d fingerprints, want 2", created)
+	}
+
+	// Failures aren't cached.
+	meta.Types = FingerprintTypeVideo
+	fail := errors.New("fail")
+	if _, err := cache.getOrCreate(meta, nopLogf, func() (*Fingerprint, error) { return nil, fail }); err != fail {
+		t.Errorf("getOrCreate: got error %v, want %v", err, fail)
+	}
+	cache.getOrCreate(meta, nopLogf, create)
+	if created != 3 {
+		t.Errorf("created %d fingerprints, want 3", created)
+	}
+
+	want := FingerprintCacheStats{Hits: 2, Misses: 4}
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Get(string) (*Fingerprint, error) { return nil, errors.New("get") }
+func (failingStore) Put(string, *Fingerprint) error   { return errors.New("put") }
+
+func TestFingerprintCacheStoreErrors(t *testing.T) {
+	cache := NewFingerprintCache(failingStore{})
+
+	var logged int
+	logf := func(string, ...any) { logged++ }
+
+	ft, err := cache.getOrCreate(FingerprintMetadata{}, logf, func() (*Fingerprint, error) {
+		return newTestFingerprint(4), nil
+	})
+	if err != nil || ft == nil {
+		t.Fatalf("getOrCreate = %v, %v, want the created fingerprint", ft, err)
+	}
+	if logged != 2 {
+		t.Errorf("logged %d errors, want 2", logged)
+	}
+	want := FingerprintCacheStats{Misses: 1, Errors: 2}
+	if got := cache.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFingerprintCacheConcurrent(t *testing.T) {
+	const n = 8
+
+	cache := NewFingerprintCache(NewMemoryFingerprintStore(1 << 20))
+	meta := FingerprintMetadata{Types: FingerprintTypeAudio, SourceSHA256: "abc"}
+
+	var created atomic.Int32
+	release := make(chan struct{})
+	create := func() (*Fingerprint, error) {
+		created.Add(1)
+		<-release
+		return newTestFingerprint(4), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*Fingerprint, n)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cache.getOrCreate(meta, nopLogf, create)
+		}(i)
+	}
+
+	// Give the other requests time to start waiting. The ones that start
+	// later find the fingerprint in the store.
+	for cache.Stats().Misses == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := created.Load(); got != 1 {
+		t.Errorf("created %d fingerprints, want 1", got)
+	}
+	for i, ft := range results {
+		if ft == nil {
+			t.Fatalf("request %d: got nil", i)
+		}
+		for j := 0; j < i; j++ {
+			if ft == results[j] {
+				t.Errorf("requests %d and %d share a fingerprint", j, i)
+			}
+		}
+	}
+	if got := cache.Stats(); got.Hits+got.Misses != n {
+		t.Errorf("Stats() = %+v, want %d requests", got, n)
+	}
+}
+
+func TestFingerprintCacheConcurrentFailure(t *testing.T) {
+	cache := NewFingerprintCache(NewMemoryFingerprintStore(1 << 20))
+	meta := FingerprintMetadata{Types: FingerprintTypeAudio, SourceSHA256: "abc"}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fail := errors.New("fail")
+
+	first, second := make(chan error), make(chan error)
+	go func() {
+		_, err := cache.getOrCreate(meta, nopLogf, func() (*Fingerprint, error) {
+			close(started)
+			<-release
+			return nil, fail
+		})
+		first <- err
+	}()
+	<-started
+
+	// The second request waits for the first one and creates the
+	// fingerprint itself when it fails.
+	go func() {
+		_, err := cache.getOrCreate(meta, nopLogf, func() (*Fingerprint, error) {
+			return newTestFingerprint(4), nil
+		})
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if err := <-first; err != fail {
+		t.Errorf("first request: got error %v, want %v", err, fail)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("second request: got error %v", err)
+	}
+}
@@ -2,60 +2,417 @@
 
 package pex
 
-// #include <pex/sdk/init.h>
 // #include <pex/sdk/lock.h>
 // #include <pex/sdk/client.h>
 // #include <stdlib.h>
 import "C"
-import "unsafe"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
 
-func newClient(typ C.Pex_ClientType, clientID, clientSecret string) (*C.Pex_Client, error) {
+// ErrClientClosed is returned by all the operations performed on a client
+// (or on objects created by it, e.g. futures and listers) after the client
+// was closed.
+var ErrClientClosed = errors.New("client is closed")
+
+// client holds the state shared by all the client types.
+type client struct {
+	typ      C.Pex_ClientType
+	provider CredentialsProvider
+	opts     *options
+
+	mu        sync.RWMutex
+	gen       *generation
+	clientID  string
+	secret    string
+	closed    bool
+	closeOnce sync.Once
+
+	// refreshing is held by refresh while it re-initializes the client and
+	// by close, so that they don't run at the same time.
+	refreshing chan struct{}
+
+	// retired counts the generations replaced by refresh whose native
+	// clients aren't deleted yet.
+	retired sync.WaitGroup
+
+	// secrets holds all the secrets the client was ever initialized with,
+	// so that they can be redacted from errors and logs.
+	secretsMu sync.Mutex
+	secrets   []string
+}
+
+// generation is a native client together with the operations using it. The
+// current generation is replaced by a new one whenever the credentials are
+// rotated, the operations that already started keep using the old one.
+type generation struct {
+	c        *C.Pex_Client
+	inflight sync.WaitGroup
+}
+
+func newClient(ctx context.Context, typ C.Pex_ClientType, provider CredentialsProvider, opts []Option) (*client, error) {
+	if err := checkCompatibility(); err != nil {
+		return nil, err
+	}
+
+	creds, err := provider.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &client{
+		typ:        typ,
+		clientID:   creds.ClientID,
+		secret:     creds.ClientSecret,
+		provider:   provider,
+		opts:       newOptions(opts),
+		refreshing: make(chan struct{}, 1),
+	}
+	x.addSecret(creds.ClientSecret)
+
+	if err := acquireRuntime(creds.ClientID, creds.ClientSecret); err != nil {
+		return nil, x.redactError(err)
+	}
+
+	cClient, err := initClient(typ, creds.ClientID, creds.ClientSecret)
+	if err != nil {
+		releaseRuntime(creds.ClientID)
+		return nil, x.redactError(err)
+	}
+	x.gen = &generation{c: cClient}
+	return x, nil
+}
+
+func initClient(typ C.Pex_ClientType, clientID, clientSecret string) (*C.Pex_Client, error) {
 	cClientID := C.CString(clientID)
 	defer C.free(unsafe.Pointer(cClientID))
 
 	cClientSecret := C.CString(clientSecret)
 	defer C.free(unsafe.Pointer(cClientSecret))
 
-	var cStatusCode C.int
-	cStatusMessage := make([]C.char, 100)
-	cStatusMessageSize := C.size_t(len(cStatusMessage))
-
-	C.Pex_Init(cClientID, cClientSecret, &cStatusCode, &cStatusMessage[0], cStatusMessageSize)
-	if StatusCode(cStatusCode) != StatusOK {
-		return nil, &Error{
-			Code:    StatusCode(cStatusCode),
-			Message: C.GoString(&cStatusMessage[0]),
-		}
-	}
-
 	C.Pex_Lock()
 	defer C.Pex_Unlock()
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cStatus, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
+	// The client isn't allocated using the allocator, since it outlives
+	// this function.
 	cClient := C.Pex_Client_New()
 	if cClient == nil {
-		panic("out of memory")
+		return nil, errOutOfMemory("client")
 	}
 
 	C.Pex_Client_Init(cClient, typ, cClientID, cClientSecret, cStatus)
 	if err := statusToError(cStatus); err != nil {
-		// TODO: if this fails, run Pex_Cleanup
-		C.free(unsafe.Pointer(cClient))
+		C.Pex_Client_Delete(&cClient)
 		return nil, err
 	}
 	return cClient, nil
 }
 
-func closeClient(c **C.Pex_Client) error {
+func deleteClient(cClient *C.Pex_Client) {
 	C.Pex_Lock()
-	C.Pex_Client_Delete(c)
+	C.Pex_Client_Delete(&cClient)
 	C.Pex_Unlock()
+}
+
+// begin registers a new in-flight operation using the current native
+// client, unless the client is already closed. Every successful call must be
+// paired with a call to end.
+func (x *client) begin() (*generation, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if x.closed {
+		return nil, ErrClientClosed
+	}
+	x.gen.inflight.Add(1)
+	return x.gen, nil
+}
+
+func (x *client) end(gen *generation) {
+	gen.inflight.Done()
+}
+
+// native returns the current native client.
+func (x *client) native() *C.Pex_Client {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.gen.c
+}
+
+// refresh retrieves the credentials from the provider and, if they changed
+// since the client was initialized, re-initializes the native client with the
+// new ones. The new operations use the new native client right away, the old
+// one is deleted once all the operations that use it finish. refresh waits
+// for that, unless the context is done first, in which case the old native
+// client is deleted in the background. It reports whether the client was
+// re-initialized.
+func (x *client) refresh(ctx context.Context) (bool, error) {
+	old, err := x.reinit(ctx)
+	if old == nil || err != nil {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer x.retired.Done()
+		old.inflight.Wait()
+		deleteClient(old.c)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// reinit implements refresh. It returns the replaced generation, or nil if
+// the credentials didn't change.
+func (x *client) reinit(ctx context.Context) (*generation, error) {
+	select {
+	case x.refreshing <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-x.refreshing }()
+
+	x.mu.RLock()
+	closed, clientID, secret := x.closed, x.clientID, x.secret
+	x.mu.RUnlock()
+	if closed {
+		return nil, ErrClientClosed
+	}
+
+	creds, err := x.provider.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	x.addSecret(creds.ClientSecret)
+
+	if creds.ClientID == clientID && creds.ClientSecret == secret {
+		return nil, nil
+	}
+
+	if err := switchRuntime(clientID, creds.ClientID, creds.ClientSecret); err != nil {
+		return nil, x.redactError(err)
+	}
+
+	cClient, err := initClient(x.typ, creds.ClientID, creds.ClientSecret)
+	if err != nil {
+		// Restore the previous registration, the old native client stays.
+		switchRuntime(creds.ClientID, clientID, secret)
+		return nil, x.redactError(err)
+	}
 
-	C.Pex_Cleanup()
+	x.mu.Lock()
+	if x.closed {
+		// close waits for refreshing, so it didn't release the runtime yet.
+		x.mu.Unlock()
+		deleteClient(cClient)
+		switchRuntime(creds.ClientID, clientID, secret)
+		return nil, ErrClientClosed
+	}
+	old := x.gen
+	x.gen = &generation{c: cClient}
+	x.clientID = creds.ClientID
+	x.secret = creds.ClientSecret
+	x.retired.Add(1)
+	x.mu.Unlock()
+
+	x.logf("client re-initialized with rotated credentials")
+	return old, nil
+}
+
+// close waits for all the in-flight operations to finish, deletes the native
+// client and releases the native library if this was the last live client.
+// Only the first call has any effect, but all the calls return only after
+// the resources are released.
+func (x *client) close() error {
+	x.closeOnce.Do(func() {
+		x.mu.Lock()
+		x.closed = true
+		x.mu.Unlock()
+
+		// Wait for a refresh in progress, it can't start a new one anymore.
+		x.refreshing <- struct{}{}
+		defer func() { <-x.refreshing }()
+
+		x.gen.inflight.Wait()
+		x.retired.Wait()
+
+		deleteClient(x.gen.c)
+		releaseRuntime(x.clientID)
+	})
 	return nil
 }
+
+// call performs the operation identified by op while honoring the client
+// options: it applies the default timeout, invokes the hooks and, if the
+// operation is idempotent, retries it according to the retry policy. If the
+// operation fails because the client is no longer authenticated, the
+// credentials are refreshed and the operation is retried once. Every
+// attempt is registered as an in-flight operation, so that the client isn't
+// closed under it, even if the caller stops waiting for it.
+func call[T any](ctx context.Context, x *client, op string, idempotent bool, fn func(ctx context.Context, c *C.Pex_Client) (T, error)) (res T, err error) {
+	if x.opts.timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, x.opts.timeout)
+			defer cancel()
+		}
+	}
+
+	if x.opts.hooks.OnStart != nil {
+		x.opts.hooks.OnStart(op)
+	}
+	if x.opts.hooks.OnFinish != nil {
+		defer func(start time.Time) {
+			x.opts.hooks.OnFinish(op, time.Since(start), err)
+		}(time.Now())
+	}
+
+	var policy *RetryPolicy
+	if idempotent {
+		policy = x.opts.retryPolicy
+	}
+
+	refreshed := false
+	return retry(ctx, op, policy, &x.opts.hooks, x.logf, func(ctx context.Context) (T, error) {
+		res, err := runContext(ctx, func() (T, error) {
+			gen, err := x.begin()
+			if err != nil {
+				var zero T
+				return zero, err
+			}
+			defer x.end(gen)
+
+			return fn(ctx, gen.c)
+		})
+		return res, x.redactError(err)
+	}, func(ctx context.Context, err error) bool {
+		if refreshed || !isUnauthenticated(err) {
+			return false
+		}
+		refreshed = true
+
+		ok, err := x.refresh(ctx)
+		if err != nil {
+			x.logf("failed to refresh credentials: %v", err)
+		}
+		return ok
+	})
+}
+
+// retry performs the attempts of the operation identified by op. It calls
+// attempt until it succeeds or until the policy, which is nil if the
+// operation isn't retried, says otherwise. After a failed attempt, again is
+// consulted first: if it returns true, the attempt is repeated right away
+// and doesn't count. The policy's Budget applies to the attempts as well as
+// to the delays between them.
+func retry[T any](ctx context.Context, op string, policy *RetryPolicy, hooks *Hooks, logf func(string, ...any), attempt func(context.Context) (T, error), again func(context.Context, error) bool) (res T, err error) {
+	if policy != nil && policy.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Budget)
+		defer cancel()
+	}
+
+	begin := time.Now()
+	for n := 1; ; n++ {
+		attemptStart := time.Now()
+		res, err = attempt(ctx)
+
+		if hooks.OnAttempt != nil {
+			hooks.OnAttempt(op, n, time.Since(attemptStart), err)
+		}
+
+		if err != nil && again != nil && again(ctx, err) {
+			n--
+			continue
+		}
+
+		if err == nil || policy == nil || !policy.shouldRetry(n, err) {
+			return res, err
+		}
+
+		// Don't bother waiting if the budget would run out in the meantime.
+		backoff := policy.backoff(n, err)
+		if policy.Budget > 0 && time.Since(begin)+backoff > policy.Budget {
+			logf("%s failed (attempt %d/%d), retry budget of %v exhausted: %v", op, n, policy.MaxAttempts, policy.Budget, err)
+			return res, err
+		}
+
+		logf("%s failed (attempt %d/%d), retrying in %v: %v", op, n, policy.MaxAttempts, backoff, err)
+		if hooks.OnRetry != nil {
+			hooks.OnRetry(op, n, backoff, err)
+		}
+
+		if err := sleepContext(ctx, backoff); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+func isUnauthenticated(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == StatusUnauthenticated
+}
+
+func (x *client) logf(format string, v ...any) {
+	if x.opts.logger != nil {
+		x.opts.logger.Printf("pex: %s", x.redact(fmt.Sprintf(format, v...)))
+	}
+}
+
+func (x *client) addSecret(secret string) {
+	x.secretsMu.Lock()
+	defer x.secretsMu.Unlock()
+
+	for _, s := range x.secrets {
+		if s == secret {
+			return
+		}
+	}
+	x.secrets = append(x.secrets, secret)
+}
+
+// redact replaces all the secrets the client was ever initialized with in
+// the given string.
+func (x *client) redact(s string) string {
+	x.secretsMu.Lock()
+	defer x.secretsMu.Unlock()
+
+	for _, secret := range x.secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// redactError redacts the secrets from the message of the Error wrapped by
+// err, if any. Errors created by other packages (e.g. by encoding/json)
+// can't contain the secret.
+func (x *client) redactError(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		e.Message = x.redact(e.Message)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingHooks returns hooks appending the attempts and retries to events.
+func recordingHooks(events *[]string) *Hooks {
+	return &Hooks{
+		OnAttempt: func(op string, attempt int, duration time.Duration, err error) {
+			*events = append(*events, fmt.Sprintf("attempt %d: %v", attempt, err))
+		},
+		OnRetry: func(op string, attempt int, backoff time.Duration, err error) {
+			*events = append(*events, fmt.Sprintf("retry %d", attempt))
+		},
+	}
+}
+
+// failingAttempt returns an attempt function failing with the errors in turn
+// and succeeding after them.
+func failingAttempt(calls *int, errs ...error) func(context.Context) (int, error) {
+	return func(ctx context.Context) (int, error) {
+		*calls++
+		if *calls <= len(errs) {
+			return 0, errs[*calls-1]
+		}
+		return 42, nil
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retryable := &Error{Code: StatusConnectionError, Message: "retryable", IsRetryable: true}
+	permanent := &Error{Code: StatusInvalidInput, Message: "permanent"}
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	tests := []struct {
+		name       string
+		policy     *RetryPolicy
+		errs       []error
+		wantErr    error
+		wantEvents []string
+	}{
+		{
+			name:       "success",
+			policy:     policy,
+			wantEvents: []string{"attempt 1: <nil>"},
+		},
+		{
+			name:       "retried",
+			policy:     policy,
+			errs:       []error{retryable, retryable},
+			wantEvents: []string{"attempt 1: 9: retryable", "retry 1", "attempt 2: 9: retryable", "retry 2", "attempt 3: <nil>"},
+		},
+		{
+			name:       "attempts exhausted",
+			policy:     policy,
+			errs:       []error{retryable, retryable, retryable},
+			wantErr:    retryable,
+			wantEvents: []string{"attempt 1: 9: retryable", "retry 1", "attempt 2: 9: retryable", "retry 2", "attempt 3: 9: retryable"},
+		},
+		{
+			name:       "not retryable",
+			policy:     policy,
+			errs:       []error{permanent},
+			wantErr:    permanent,
+			wantEvents: []string{"attempt 1: 5: permanent"},
+		},
+		{
+			name:       "no policy",
+			errs:       []error{retryable},
+			wantErr:    retryable,
+			wantEvents: []string{"attempt 1: 9: retryable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			var calls int
+			res, err := retry(context.Background(), "Op", tt.policy, recordingHooks(&events), nopLogf, failingAttempt(&calls, tt.errs...), nil)
+
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && res != 42 {
+				t.Errorf("got result %d, want 42", res)
+			}
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("got events %q, want %q", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestRetryAgain(t *testing.T) {
+	unauthenticated := &Error{Code: StatusUnauthenticated, Message: "unauthenticated"}
+
+	var events []string
+	var calls int
+	again := func(ctx context.Context, err error) bool {
+		return isUnauthenticated(err) && calls == 1
+	}
+	res, err := retry(context.Background(), "Op", nil, recordingHooks(&events), nopLogf, failingAttempt(&calls, unauthenticated), again)
+	if err != nil || res != 42 {
+		t.Fatalf("retry = %d, %v, want 42, nil", res, err)
+	}
+
+	// The repeated attempt doesn't count, even without a policy.
+	want := []string{"attempt 1: 3: unauthenticated", "attempt 1: <nil>"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %q, want %q", events, want)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	retryable := &Error{Code: StatusConnectionError, IsRetryable: true}
+
+	// The delay would exceed the budget.
+	policy := &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, Budget: 500 * time.Millisecond}
+	var calls int
+	start := time.Now()
+	_, err := retry(context.Background(), "Op", policy, &Hooks{}, nopLogf, failingAttempt(&calls, retryable, retryable), nil)
+	if err != retryable || calls != 1 {
+		t.Errorf("got error %v after %d attempts, want %v after 1", err, calls, retryable)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("waited %v for a delay exceeding the budget", elapsed)
+	}
+
+	// A slow attempt is interrupted when the budget runs out.
+	policy = &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond, Budget: 20 * time.Millisecond}
+	_, err = retry(context.Background(), "Op", policy, &Hooks{}, nopLogf, func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
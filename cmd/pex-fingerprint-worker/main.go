@@ -0,0 +1,30 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+// Command pex-fingerprint-worker is the companion binary of
+// pex.FingerprintWorkerPool. It's started by the pool and communicates with
+// it over stdin and stdout; it's not meant to be run manually.
+//
+// The credentials are read from the PEX_CLIENT_ID and PEX_CLIENT_SECRET
+// environment variables.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	pex "github.com/Pexeso/pex-sdk-go/v4"
+)
+
+func main() {
+	private := flag.Bool("private", false, "use a private search client")
+	flag.Parse()
+
+	log.SetPrefix("pex-fingerprint-worker: ")
+	log.SetFlags(0)
+
+	if err := pex.ServeFingerprintWorker(context.Background(), os.Stdin, os.Stdout, *private); err != nil {
+		log.Fatal(err)
+	}
+}
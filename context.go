@@ -0,0 +1,72 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+// #include <pex/sdk/lock.h>
+import "C"
+import (
+	"context"
+	"time"
+)
+
+// runContext calls fn and waits until it either returns or the context is
+// done, whichever happens first. Native calls can't be interrupted, so if the
+// context is done first, fn keeps running in the background, releases all the
+// resources it allocated once the native call returns and its result is
+// discarded.
+func runContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	// Contexts that can never be canceled don't need the extra goroutine.
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	type result struct {
+		val T
+		err error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		ch <- result{val: val, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.val, res.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// lockContext acquires the global lock of the native library. If the context
+// is done by the time the lock is acquired, the lock is released immediately
+// and the context error is returned, so that abandoned calls queued behind a
+// slow one don't reach the backend at all.
+func lockContext(ctx context.Context) error {
+	C.Pex_Lock()
+	if err := ctx.Err(); err != nil {
+		C.Pex_Unlock()
+		return err
+	}
+	return nil
+}
+
+// sleepContext pauses the current goroutine for the given duration or until
+// the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// ErrNoCredentials is returned by a CredentialsProvider that has no
+// credentials to provide.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Credentials are used to authenticate a client with the backend
+// service. The secret is never included in the output of the fmt package.
+type Credentials struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+func (x Credentials) String() string {
+	return fmt.Sprintf("{ClientID:%s ClientSecret:%s}", x.ClientID, redacted)
+}
+
+func (x Credentials) GoString() string {
+	return fmt.Sprintf("pex.Credentials{ClientID:%q, ClientSecret:%q}", x.ClientID, redacted)
+}
+
+func (x Credentials) validate() error {
+	if x.ClientID == "" || x.ClientSecret == "" {
+		return fmt.Errorf("%w: client ID and secret must not be empty", ErrNoCredentials)
+	}
+	return nil
+}
+
+// CredentialsProvider supplies the credentials used to authenticate a
+// client. It's consulted when the client is created and every time the
+// credentials need to be refreshed, so it should return the latest
+// credentials if they can rotate.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialsProviderFunc is an adapter that allows to use an ordinary
+// function as a CredentialsProvider.
+type CredentialsProviderFunc func(ctx context.Context) (Credentials, error)
+
+func (f CredentialsProviderFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// StaticCredentials returns a provider that always returns the given
+// credentials.
+func StaticCredentials(clientID, clientSecret string) CredentialsProvider {
+	return CredentialsProviderFunc(func(context.Context) (Credentials, error) {
+		creds := Credentials{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+		}
+		return creds, creds.validate()
+	})
+}
+
+// EnvCredentials returns a provider that reads the credentials from the
+// PEX_CLIENT_ID and PEX_CLIENT_SECRET environment variables.
+func EnvCredentials() CredentialsProvider {
+	return CredentialsProviderFunc(func(context.Context) (Credentials, error) {
+		creds := Credentials{
+			ClientID:     os.Getenv("PEX_CLIENT_ID"),
+			ClientSecret: os.Getenv("PEX_CLIENT_SECRET"),
+		}
+		if err := creds.validate(); err != nil {
+			return Credentials{}, fmt.Errorf("PEX_CLIENT_ID or PEX_CLIENT_SECRET not set: %w", err)
+		}
+		return creds, nil
+	})
+}
+
+// FileCredentials returns a provider that reads the credentials from a
+// JSON file in the following format:
+//
+//	{"client_id": "...", "client_secret": "..."}
+//
+// The file is read every time the credentials are requested, so rotated
+// credentials are picked up when the client is refreshed.
+func FileCredentials(path string) CredentialsProvider {
+	return CredentialsProviderFunc(func(context.Context) (Credentials, error) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("failed to read credentials: %w", err)
+		}
+
+		var creds Credentials
+		if err := json.Unmarshal(b, &creds); err != nil {
+			// Don't wrap the error, it might contain parts of the secret.
+			return Credentials{}, fmt.Errorf("failed to parse credentials file %s", path)
+		}
+		if err := creds.validate(); err != nil {
+			return Credentials{}, fmt.Errorf("invalid credentials file %s: %w", path, err)
+		}
+		return creds, nil
+	})
+}
+
+// ChainCredentials returns a provider that returns the credentials of the
+// first provider that succeeds. If none of them does, all their errors are
+// returned.
+func ChainCredentials(providers ...CredentialsProvider) CredentialsProvider {
+	return CredentialsProviderFunc(func(ctx context.Context) (Credentials, error) {
+		var errs []string
+		for _, p := range providers {
+			creds, err := p.Credentials(ctx)
+			if err == nil {
+				return creds, nil
+			}
+			errs = append(errs, err.Error())
+		}
+		if len(errs) == 0 {
+			return Credentials{}, ErrNoCredentials
+		}
+		return Credentials{}, fmt.Errorf("%w: %s", ErrNoCredentials, strings.Join(errs, "; "))
+	})
+}
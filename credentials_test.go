@@ -0,0 +1,128 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSecret = "s3cr3t"
+
+func TestCredentialsFormatting(t *testing.T) {
+	creds := Credentials{ClientID: "id", ClientSecret: testSecret}
+
+	for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+		for _, v := range []any{creds, &creds, []Credentials{creds}} {
+			if got := fmt.Sprintf(format, v); strings.Contains(got, testSecret) || !strings.Contains(got, "id") {
+				t.Errorf("Sprintf(%q, %T) = %q, want the ID without the secret", format, v, got)
+			}
+		}
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	tests := []struct {
+		id, secret string
+		wantErr    bool
+	}{
+		{"id", testSecret, false},
+		{"", testSecret, true},
+		{"id", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("PEX_CLIENT_ID", tt.id)
+		t.Setenv("PEX_CLIENT_SECRET", tt.secret)
+
+		creds, err := EnvCredentials().Credentials(context.Background())
+		if tt.wantErr {
+			if !errors.Is(err, ErrNoCredentials) {
+				t.Errorf("id %q, secret %q: got error %v, want %v", tt.id, tt.secret, err, ErrNoCredentials)
+			}
+			continue
+		}
+		if err != nil || creds != (Credentials{ClientID: tt.id, ClientSecret: tt.secret}) {
+			t.Errorf("id %q, secret %q: got %v, %v", tt.id, tt.secret, creds, err)
+		}
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string // no file is written if empty
+		wantErr error
+	}{
+		{"valid", `{"client_id": "id", "client_secret": "` + testSecret + `"}`, nil},
+		{"missing", "", os.ErrNotExist},
+		{"malformed", `{"client_id": "id", "client_secret": "` + testSecret, nil},
+		{"incomplete", `{"client_id": "id"}`, ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".json")
+		if tt.content != "" {
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		creds, err := FileCredentials(path).Credentials(context.Background())
+		switch {
+		case tt.name == "valid":
+			if err != nil || creds.ClientID != "id" || creds.ClientSecret != testSecret {
+				t.Errorf("%s: got %v, %v", tt.name, creds, err)
+			}
+		case err == nil:
+			t.Errorf("%s: got no error", tt.name)
+		case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		case strings.Contains(err.Error(), testSecret):
+			t.Errorf("%s: error %q contains the secret", tt.name, err)
+		}
+	}
+}
+
+func TestChainCredentials(t *testing.T) {
+	var calls []string
+	provider := func(name string, err error) CredentialsProvider {
+		return CredentialsProviderFunc(func(context.Context) (Credentials, error) {
+			calls = append(calls, name)
+			if err != nil {
+				return Credentials{}, err
+			}
+			return Credentials{ClientID: name, ClientSecret: testSecret}, nil
+		})
+	}
+
+	creds, err := ChainCredentials(
+		provider("a", errors.New("a failed")),
+		provider("b", nil),
+		provider("c", nil),
+	).Credentials(context.Background())
+	if err != nil || creds.ClientID != "b" {
+		t.Errorf("got %v, %v, want the credentials of b", creds, err)
+	}
+	if got := strings.Join(calls, ","); got != "a,b" {
+		t.Errorf("called %s, want a,b", got)
+	}
+
+	_, err = ChainCredentials(
+		provider("a", errors.New("a failed")),
+		provider("b", errors.New("b failed")),
+	).Credentials(context.Background())
+	if !errors.Is(err, ErrNoCredentials) || !strings.Contains(err.Error(), "a failed") || !strings.Contains(err.Error(), "b failed") {
+		t.Errorf("got error %v, want ErrNoCredentials with both errors", err)
+	}
+
+	if _, err := ChainCredentials().Credentials(context.Background()); err != ErrNoCredentials {
+		t.Errorf("empty chain: got error %v, want %v", err, ErrNoCredentials)
+	}
+}
@@ -7,59 +7,34 @@ package pex
 // #include <pex/sdk/fingerprint.h>
 import "C"
 import (
-	"encoding/json"
-	"errors"
+	"context"
+	"time"
 	"unsafe"
 )
 
-// FingerprintType is a bit flag specifying one or more fingerprint types.
-type FingerprintType int
-
-func (x *FingerprintType) UnmarshalJSON(data []byte) error {
-	var temp string
-	if err := json.Unmarshal(data, &temp); err != nil {
-		return err
-	}
-
-	switch temp {
-	case "video":
-		*x = FingerprintTypeVideo
-	case "audio":
-		*x = FingerprintTypeAudio
-	case "melody":
-		*x = FingerprintTypeMelody
-	case "phonetic":
-		*x = FingerprintTypePhonetic
-	case "class":
-		*x = FingerprintTypeClassification
-	default:
-		return errors.New("invalid fingerprint_type value")
-	}
-
-	return nil
-}
-
-const (
-	FingerprintTypeVideo          FingerprintType = 1
-	FingerprintTypeAudio          FingerprintType = 2
-	FingerprintTypeMelody         FingerprintType = 4
-	FingerprintTypePhonetic       FingerprintType = 8
-	FingerprintTypeClassification FingerprintType = 16
-	FingerprintTypeAll                            = FingerprintTypeAudio | FingerprintTypeMelody | FingerprintTypePhonetic
-)
-
 // Fingerprint is how the SDK identifies a piece of digital content.
 // It can be generated from a media file or from a memory buffer. The
 // content must be encoded in one of the supported formats and must be
 // longer than 1 second.
 type Fingerprint struct {
 	b []byte
+
+	// Metadata describes the fingerprint. It's not part of Dump, use
+	// WriteTo or SaveFile to store it together with the fingerprint.
+	Metadata FingerprintMetadata
 }
 
 func (x *Fingerprint) Dump() []byte {
 	return x.b
 }
 
+// Offset returns the position in the original media file where the
+// fingerprinted range starts. It's zero unless the fingerprint was created
+// from a time range using FingerprintOptions.
+func (x *Fingerprint) Offset() time.Duration {
+	return x.Metadata.Offset
+}
+
 func NewFingerprint(b []byte) *Fingerprint {
 	return &Fingerprint{
 		b: b,
@@ -67,7 +42,7 @@ func NewFingerprint(b []byte) *Fingerprint {
 }
 
 type fingerprinter struct {
-	c *C.Pex_Client
+	*client
 }
 
 // FingerprintFile is used to generate a fingerprint from a
@@ -76,7 +51,27 @@ type fingerprinter struct {
 // specifies which types of fingerprints to create. If not
 // types are provided, FingerprintTypeAll is assumed.
 func (x *fingerprinter) FingerprintFile(path string, types ...FingerprintType) (*Fingerprint, error) {
-	return x.newFingerprint([]byte(path), true, reduceTypes(types))
+	return x.FingerprintFileContext(context.Background(), path, types...)
+}
+
+// FingerprintFileContext is like FingerprintFile but returns ctx.Err()
+// as soon as the context is done. The fingerprinting itself can't be
+// interrupted, it will finish in the background and its result will be
+// discarded.
+func (x *fingerprinter) FingerprintFileContext(ctx context.Context, path string, types ...FingerprintType) (*Fingerprint, error) {
+	if err := validatePath(path); err != nil {
+		return nil, err
+	}
+	if err := validateTypes(types); err != nil {
+		return nil, err
+	}
+	if err := x.opts.checkMedia([]byte(path), true); err != nil {
+		return nil, err
+	}
+
+	return call(ctx, x.client, "FingerprintFile", false, func(ctx context.Context, c *C.Pex_Client) (*Fingerprint, error) {
+		return x.fingerprint(ctx, c, []byte(path), true, reduceTypes(types))
+	})
 }
 
 // FingerprintBuffer is used to generate a fingerprint from a
@@ -84,7 +79,47 @@ func (x *fingerprinter) FingerprintFile(path string, types ...FingerprintType) (
 // specifies which types of fingerprints to create. If not
 // types are provided, FingerprintTypeAll is assumed.
 func (x *fingerprinter) FingerprintBuffer(buffer []byte, types ...FingerprintType) (*Fingerprint, error) {
-	return x.newFingerprint(buffer, false, reduceTypes(types))
+	return x.FingerprintBufferContext(context.Background(), buffer, types...)
+}
+
+// FingerprintBufferContext is like FingerprintBuffer but returns
+// ctx.Err() as soon as the context is done. The buffer must not be
+// modified until the fingerprinting finishes in the background.
+func (x *fingerprinter) FingerprintBufferContext(ctx context.Context, buffer []byte, types ...FingerprintType) (*Fingerprint, error) {
+	if err := validateBuffer(buffer); err != nil {
+		return nil, err
+	}
+	if err := validateTypes(types); err != nil {
+		return nil, err
+	}
+	if err := x.opts.checkMedia(buffer, false); err != nil {
+		return nil, err
+	}
+
+	return call(ctx, x.client, "FingerprintBuffer", false, func(ctx context.Context, c *C.Pex_Client) (*Fingerprint, error) {
+		return x.fingerprint(ctx, c, buffer, false, reduceTypes(types))
+	})
+}
+
+// fingerprint creates the fingerprint of the input, which is either a path or
+// the media itself, or looks it up in the cache, if configured. The media is
+// only hashed if the cache or WithSourceMetadata needs it.
+func (x *fingerprinter) fingerprint(ctx context.Context, c *C.Pex_Client, input []byte, isFile bool, typ FingerprintType) (*Fingerprint, error) {
+	meta := newFingerprintMetadata(typ)
+	if x.opts.cache != nil || x.opts.sourceMetadata {
+		if err := meta.describeSource(ctx, input, isFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return x.opts.cache.getOrCreate(meta, x.logf, func() (*Fingerprint, error) {
+		ft, err := x.newFingerprint(ctx, c, input, isFile, typ)
+		if err != nil {
+			return nil, err
+		}
+		ft.Metadata = meta
+		return ft, nil
+	})
 }
 
 func reduceTypes(in []FingerprintType) (out FingerprintType) {
@@ -98,42 +133,40 @@ func reduceTypes(in []FingerprintType) (out FingerprintType) {
 	return out
 }
 
-func (x *fingerprinter) newFingerprint(input []byte, isFile bool, typ FingerprintType) (*Fingerprint, error) {
-	C.Pex_Lock()
+func (x *fingerprinter) newFingerprint(ctx context.Context, c *C.Pex_Client, input []byte, isFile bool, typ FingerprintType) (*Fingerprint, error) {
+	if err := lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer C.Pex_Unlock()
 
-	status := C.Pex_Status_New()
-	if status == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	status, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&status)
 
-	ft := C.Pex_Buffer_New()
-	if ft == nil {
-		panic("out of memory")
+	ft, err := a.buffer()
+	if err != nil {
+		return nil, err
 	}
 
 	if isFile {
 		cFile := C.CString(string(input))
 		defer C.free(unsafe.Pointer(cFile))
 
-		C.Pex_FingerprintFile(x.c, cFile, ft, status, C.int(typ))
+		C.Pex_FingerprintFile(c, cFile, ft, status, C.int(typ))
 	} else {
-		buf := C.Pex_Buffer_New()
-		if buf == nil {
-			panic("out of memory")
+		buf, err := a.bufferFrom(input)
+		if err != nil {
+			return nil, err
 		}
-		defer C.Pex_Buffer_Delete(&buf)
-
-		data := unsafe.Pointer(&input[0])
-		size := C.size_t(len(input))
 
-		C.Pex_Buffer_Set(buf, data, size)
-		C.Pex_FingerprintBuffer(x.c, buf, ft, status, C.int(typ))
+		C.Pex_FingerprintBuffer(c, buf, ft, status, C.int(typ))
 	}
 
 	if err := statusToError(status); err != nil {
-		C.Pex_Buffer_Delete(&ft)
 		return nil, err
 	}
 
@@ -0,0 +1,279 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FingerprintDirOptions configure FingerprintDir.
+type FingerprintDirOptions struct {
+	// Include lists glob patterns (see path.Match) of the files to
+	// fingerprint. Patterns containing a slash are matched against the
+	// slash-separated path relative to the root, other patterns against the
+	// file name. If empty, all files are fingerprinted.
+	Include []string
+
+	// Exclude lists glob patterns of the files and directories to skip. They
+	// are matched the same way as Include and take precedence over it.
+	Exclude []string
+
+	// Types specifies which types of fingerprints to create. If empty,
+	// FingerprintTypeAll is assumed.
+	Types []FingerprintType
+
+	// Workers is the maximum number of files fingerprinted concurrently. It
+	// defaults to the number of CPUs.
+	Workers int
+
+	// Progress, if set, is called after every processed file. Calls are
+	// serialized.
+	Progress func(FingerprintDirProgress)
+}
+
+// FingerprintDirProgress is passed to FingerprintDirOptions.Progress.
+type FingerprintDirProgress struct {
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+	Elapsed    time.Duration
+
+	// ETA is the estimated remaining time, based on the throughput so far.
+	ETA time.Duration
+}
+
+// FingerprintDirResult is the outcome of fingerprinting a single file.
+type FingerprintDirResult struct {
+	Path        string
+	Fingerprint *Fingerprint
+	Err         error
+}
+
+// FingerprintDirSummary summarizes a finished FingerprintDirJob.
+type FingerprintDirSummary struct {
+	// Files is the number of the listed files, i.e. the files the job
+	// attempted to fingerprint.
+	Files     int
+	Succeeded int
+	Bytes     int64
+	Duration  time.Duration
+
+	// Failed maps the paths of the files that couldn't be fingerprinted to
+	// their errors.
+	Failed map[string]error
+
+	// WalkErrors maps the paths of the entries that couldn't be listed,
+	// e.g. unreadable directories, to their errors. They aren't counted in
+	// Files and aren't sent to Results.
+	WalkErrors map[string]error
+}
+
+// FingerprintDirJob represents fingerprinting of a directory started by
+// FingerprintDir.
+type FingerprintDirJob struct {
+	results chan FingerprintDirResult
+	done    chan struct{}
+	summary FingerprintDirSummary
+}
+
+// Results returns the channel the results are sent to as soon as the
+// individual files are fingerprinted. The channel is closed once all the
+// files are processed. It must be drained, otherwise the job stalls.
+func (x *FingerprintDirJob) Results() <-chan FingerprintDirResult {
+	return x.results
+}
+
+// Wait blocks until all the files are processed and returns the summary.
+// It must be called after, or concurrently with, draining Results.
+func (x *FingerprintDirJob) Wait() *FingerprintDirSummary {
+	<-x.done
+	return &x.summary
+}
+
+// FingerprintDir walks the directory tree rooted at root and fingerprints
+// all the matching files using a bounded pool of workers. Keep in mind that
+// the native library fingerprints only one file at a time within a process;
+// use FingerprintWorkerPool.FingerprintDir to fingerprint the files truly
+// in parallel.
+//
+// The files are listed before the fingerprinting starts, so that the
+// progress can be reported. Entries that can't be listed are skipped and
+// reported in FingerprintDirSummary.WalkErrors. If the context is done, the
+// remaining files fail with the context error.
+func (x *fingerprinter) FingerprintDir(ctx context.Context, root string, opts *FingerprintDirOptions) (*FingerprintDirJob, error) {
+	return fingerprintDir(ctx, x, root, opts)
+}
+
+type dirFile struct {
+	path string
+	size int64
+}
+
+func fingerprintDir(ctx context.Context, fp Fingerprinter, root string, opts *FingerprintDirOptions) (*FingerprintDirJob, error) {
+	if opts == nil {
+		opts = new(FingerprintDirOptions)
+	}
+	if err := validateTypes(opts.Types); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(opts.Include, opts.Exclude); err != nil {
+		return nil, err
+	}
+
+	files, walkErrs, err := listDir(root, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	job := &FingerprintDirJob{
+		results: make(chan FingerprintDirResult),
+		done:    make(chan struct{}),
+		summary: FingerprintDirSummary{
+			Files:      len(files),
+			Failed:     make(map[string]error),
+			WalkErrors: walkErrs,
+		},
+	}
+
+	var bytesTotal int64
+	for _, f := range files {
+		bytesTotal += f.size
+	}
+
+	start := time.Now()
+	progress := FingerprintDirProgress{
+		FilesTotal: job.summary.Files,
+		BytesTotal: bytesTotal,
+	}
+
+	var mu sync.Mutex
+	report := func(res FingerprintDirResult, size int64) {
+		mu.Lock()
+		if res.Err != nil {
+			job.summary.Failed[res.Path] = res.Err
+		} else {
+			job.summary.Succeeded++
+			job.summary.Bytes += size
+		}
+
+		progress.FilesDone++
+		progress.BytesDone += size
+		progress.Elapsed = time.Since(start)
+		progress.ETA = 0
+		if progress.BytesDone > 0 {
+			remaining := float64(progress.BytesTotal-progress.BytesDone) / float64(progress.BytesDone)
+			progress.ETA = time.Duration(remaining * float64(progress.Elapsed))
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		mu.Unlock()
+
+		job.results <- res
+	}
+
+	queue := make(chan dirFile)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				ft, err := fp.FingerprintFileContext(ctx, f.path, opts.Types...)
+				report(FingerprintDirResult{Path: f.path, Fingerprint: ft, Err: err}, f.size)
+			}
+		}()
+	}
+
+	go func() {
+		for _, f := range files {
+			queue <- f
+		}
+		close(queue)
+		wg.Wait()
+
+		job.summary.Duration = time.Since(start)
+		close(job.results)
+		close(job.done)
+	}()
+
+	return job, nil
+}
+
+// listDir lists all the regular files in the tree that match the options.
+// Errors of the individual entries are returned separately, only the error
+// of the root is fatal.
+func listDir(root string, opts *FingerprintDirOptions) ([]dirFile, map[string]error, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, nil, err
+	}
+
+	var files []dirFile
+	errs := make(map[string]error)
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			errs[p] = err
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && matchAny(opts.Exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchAny(opts.Include, rel) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			errs[p] = err
+			return nil
+		}
+		files = append(files, dirFile{path: p, size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+	return files, errs, nil
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = rel[strings.LastIndex(rel, "/")+1:]
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
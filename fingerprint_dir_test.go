@@ -0,0 +1,195 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{nil, "a.mp4", false},
+		{[]string{"*.mp4"}, "a.mp4", true},
+		{[]string{"*.mp4"}, "dir/a.mp4", true},
+		{[]string{"*.mp4"}, "a.mp3", false},
+		{[]string{"*.mp3", "*.mp4"}, "dir/sub/a.mp4", true},
+		{[]string{"dir/*.mp4"}, "dir/a.mp4", true},
+		{[]string{"dir/*.mp4"}, "a.mp4", false},
+		{[]string{"dir/*.mp4"}, "dir/sub/a.mp4", false},
+		{[]string{"dir"}, "dir", true},
+		{[]string{"dir"}, "other/dir", true},
+		{[]string{"tmp"}, "dir/tmp.mp4", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.rel); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.patterns, tt.rel, got, tt.want)
+		}
+	}
+}
+
+// writeTree creates the files in dir, the paths are slash-separated and the
+// content of every file is its path.
+func writeTree(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+
+	for _, p := range paths {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(p), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListDir(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, "a.mp4", "b.mp3", "c.txt", "dir/d.mp4", "dir/tmp/e.mp4", "tmp/f.mp4")
+
+	tests := []struct {
+		include, exclude []string
+		want             []string
+	}{
+		{nil, nil, []string{"a.mp4", "b.mp3", "c.txt", "dir/d.mp4", "dir/tmp/e.mp4", "tmp/f.mp4"}},
+		{[]string{"*.mp4", "*.mp3"}, nil, []string{"a.mp4", "b.mp3", "dir/d.mp4", "dir/tmp/e.mp4", "tmp/f.mp4"}},
+		{[]string{"*.mp4"}, []string{"tmp"}, []string{"a.mp4", "dir/d.mp4"}},
+		{[]string{"dir/*"}, nil, []string{"dir/d.mp4"}},
+		{nil, []string{"dir/tmp", "*.txt"}, []string{"a.mp4", "b.mp3", "dir/d.mp4", "tmp/f.mp4"}},
+		{[]string{"*.wav"}, nil, nil},
+	}
+	for _, tt := range tests {
+		files, errs, err := listDir(root, &FingerprintDirOptions{Include: tt.include, Exclude: tt.exclude})
+		if err != nil || len(errs) != 0 {
+			t.Errorf("include %q, exclude %q: got errors %v, %v", tt.include, tt.exclude, errs, err)
+			continue
+		}
+
+		var got []string
+		for _, f := range files {
+			rel, _ := filepath.Rel(root, f.path)
+			got = append(got, filepath.ToSlash(rel))
+			if f.size != int64(len(f.path)) {
+				t.Errorf("%s: got size %d, want %d", rel, f.size, len(f.path))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("include %q, exclude %q: got %q, want %q", tt.include, tt.exclude, got, tt.want)
+		}
+	}
+
+	if _, _, err := listDir(filepath.Join(root, "missing"), new(FingerprintDirOptions)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing root: got error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestListDirWalkErrors(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("directory permissions are not enforced for root")
+	}
+
+	root := t.TempDir()
+	writeTree(t, root, "a.mp4", "locked/b.mp4")
+
+	locked := filepath.Join(root, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0o755)
+
+	files, errs, err := listDir(root, new(FingerprintDirOptions))
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(files) != 1 || len(errs) != 1 || errs[locked] == nil {
+		t.Errorf("got files %v, errors %v, want a.mp4 and an error of %s", files, errs, locked)
+	}
+}
+
+// failingFingerprinter fails to fingerprint the files whose names start
+// with "bad". Only the methods used by fingerprintDir are implemented.
+type failingFingerprinter struct {
+	Fingerprinter
+}
+
+var errBadFile = errors.New("bad file")
+
+func (failingFingerprinter) FingerprintFileContext(ctx context.Context, path string, types ...FingerprintType) (*Fingerprint, error) {
+	if strings.HasPrefix(filepath.Base(path), "bad") {
+		return nil, errBadFile
+	}
+	return newTestFingerprint(4), nil
+}
+
+func TestFingerprintDir(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, "a.mp4", "bad.mp4", "c.txt", "dir/d.mp4", "dir/bad.mp4")
+
+	var last FingerprintDirProgress
+	opts := &FingerprintDirOptions{
+		Include:  []string{"*.mp4"},
+		Workers:  2,
+		Progress: func(p FingerprintDirProgress) { last = p },
+	}
+	job, err := fingerprintDir(context.Background(), failingFingerprinter{}, root, opts)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	var paths []string
+	for res := range job.Results() {
+		paths = append(paths, res.Path)
+		if (res.Err != nil) != strings.HasPrefix(filepath.Base(res.Path), "bad") || (res.Err == nil) != (res.Fingerprint != nil) {
+			t.Errorf("%s: got %v, %v", res.Path, res.Fingerprint, res.Err)
+		}
+	}
+	sort.Strings(paths)
+
+	var want []string
+	for _, p := range []string{"a.mp4", "bad.mp4", "dir/bad.mp4", "dir/d.mp4"} {
+		want = append(want, filepath.Join(root, filepath.FromSlash(p)))
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got results for %q, want %q", paths, want)
+	}
+
+	summary := job.Wait()
+	if summary.Files != 4 || summary.Succeeded != 2 || len(summary.Failed) != 2 || len(summary.WalkErrors) != 0 {
+		t.Errorf("got summary %+v, want 4 files, 2 succeeded and 2 failed", summary)
+	}
+	if err := summary.Failed[want[1]]; err != errBadFile {
+		t.Errorf("%s: got error %v, want %v", want[1], err, errBadFile)
+	}
+	if wantBytes := int64(len(want[0]) + len(want[3])); summary.Bytes != wantBytes {
+		t.Errorf("got %d bytes, want %d", summary.Bytes, wantBytes)
+	}
+
+	if last.FilesDone != 4 || last.FilesTotal != 4 || last.BytesDone != last.BytesTotal {
+		t.Errorf("last progress = %+v, want all files done", last)
+	}
+}
+
+func TestFingerprintDirInvalidOptions(t *testing.T) {
+	root := t.TempDir()
+
+	for _, opts := range []*FingerprintDirOptions{
+		{Include: []string{"["}},
+		{Exclude: []string{"["}},
+		{Types: []FingerprintType{0}},
+	} {
+		if _, err := fingerprintDir(context.Background(), failingFingerprinter{}, root, opts); err == nil {
+			t.Errorf("%+v: got no error", opts)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	_ encoding.BinaryMarshaler   = Fingerprint{}
+	_ encoding.BinaryUnmarshaler = (*Fingerprint)(nil)
+	_ encoding.TextMarshaler     = Fingerprint{}
+	_ encoding.TextUnmarshaler   = (*Fingerprint)(nil)
+	_ json.Marshaler             = Fingerprint{}
+	_ json.Unmarshaler           = (*Fingerprint)(nil)
+	_ driver.Valuer              = Fingerprint{}
+	_ sql.Scanner                = (*Fingerprint)(nil)
+)
+
+// MarshalBinary encodes the fingerprint together with its metadata in the
+// fingerprint file format (see Fingerprint.WriteTo). It's also used by
+// encoding/gob.
+func (x Fingerprint) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := x.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a fingerprint encoded by MarshalBinary. Like
+// ReadFingerprint, it also accepts raw fingerprints obtained by Dump.
+func (x *Fingerprint) UnmarshalBinary(data []byte) error {
+	ft, err := ReadFingerprint(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	*x = *ft
+	return nil
+}
+
+// MarshalText encodes the fingerprint as MarshalBinary does, and then
+// encodes the result using standard base64.
+func (x Fingerprint) MarshalText() ([]byte, error) {
+	data, err := x.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(text, data)
+	return text, nil
+}
+
+// UnmarshalText decodes a fingerprint encoded by MarshalText.
+func (x *Fingerprint) UnmarshalText(text []byte) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(data, text)
+	if err != nil {
+		return fmt.Errorf("invalid fingerprint encoding: %w", err)
+	}
+	return x.UnmarshalBinary(data[:n])
+}
+
+// MarshalJSON encodes the fingerprint as a JSON string containing the
+// output of MarshalText.
+func (x Fingerprint) MarshalJSON() ([]byte, error) {
+	text, err := x.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON decodes a fingerprint encoded by MarshalJSON. JSON null is
+// a no-op, like it is for the standard types.
+func (x *Fingerprint) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	return x.UnmarshalText([]byte(text))
+}
+
+// Value implements driver.Valuer, which allows to store the fingerprint in
+// a binary database column. The value is the output of MarshalBinary.
+func (x Fingerprint) Value() (driver.Value, error) {
+	return x.MarshalBinary()
+}
+
+// Scan implements sql.Scanner, which allows to read the fingerprint from a
+// database column written using Value. Scanning NULL resets the
+// fingerprint.
+func (x *Fingerprint) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*x = Fingerprint{}
+		return nil
+	case []byte:
+		return x.UnmarshalBinary(v)
+	case string:
+		return x.UnmarshalBinary([]byte(v))
+	default:
+		return fmt.Errorf("cannot scan %T into a fingerprint", src)
+	}
+}
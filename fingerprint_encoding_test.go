@@ -0,0 +1,171 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func checkFingerprint(t *testing.T, name string, got, want *Fingerprint) {
+	t.Helper()
+
+	if !bytes.Equal(got.b, want.b) || !reflect.DeepEqual(got.Metadata, want.Metadata) {
+		t.Errorf("%s = %q, %+v, want %q, %+v", name, got.b, got.Metadata, want.b, want.Metadata)
+	}
+}
+
+func TestFingerprintBinary(t *testing.T) {
+	ft := newTestFingerprintWithMetadata()
+
+	data, err := ft.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	got := new(Fingerprint)
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	checkFingerprint(t, "UnmarshalBinary", got, ft)
+
+	// Raw dumps are accepted.
+	got = new(Fingerprint)
+	if err := got.UnmarshalBinary([]byte("raw")); err != nil {
+		t.Fatalf("UnmarshalBinary of a raw dump: %v", err)
+	}
+	checkFingerprint(t, "UnmarshalBinary of a raw dump", got, &Fingerprint{b: []byte("raw")})
+
+	if err := got.UnmarshalBinary(data[:len(data)-1]); !errors.Is(err, ErrCorruptFingerprint) {
+		t.Errorf("UnmarshalBinary of a truncated fingerprint: got error %v, want %v", err, ErrCorruptFingerprint)
+	}
+}
+
+func TestFingerprintGob(t *testing.T) {
+	type record struct {
+		Name        string
+		Fingerprint *Fingerprint
+	}
+	in := record{Name: "a", Fingerprint: newTestFingerprintWithMetadata()}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var out record
+	if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if out.Name != in.Name || out.Fingerprint == nil {
+		t.Fatalf("Decode = %+v, want %+v", out, in)
+	}
+	checkFingerprint(t, "Decode", out.Fingerprint, in.Fingerprint)
+}
+
+func TestFingerprintText(t *testing.T) {
+	ft := newTestFingerprintWithMetadata()
+
+	text, err := ft.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText: %v", err)
+	}
+	got := new(Fingerprint)
+	if err := got.UnmarshalText(text); err != nil {
+		t.Fatalf("UnmarshalText: %v", err)
+	}
+	checkFingerprint(t, "UnmarshalText", got, ft)
+
+	if err := got.UnmarshalText([]byte("not base64!")); err == nil {
+		t.Error("UnmarshalText of invalid base64: got no error")
+	}
+	if err := got.UnmarshalText(text[:len(text)-8]); !errors.Is(err, ErrCorruptFingerprint) {
+		t.Errorf("UnmarshalText of a truncated fingerprint: got error %v, want %v", err, ErrCorruptFingerprint)
+	}
+}
+
+func TestFingerprintJSON(t *testing.T) {
+	type record struct {
+		Fingerprint *Fingerprint `json:"fingerprint"`
+		Missing     *Fingerprint `json:"missing"`
+		NotAPointer Fingerprint  `json:"not_a_pointer"`
+	}
+	in := record{
+		Fingerprint: newTestFingerprintWithMetadata(),
+		NotAPointer: Fingerprint{b: []byte("raw")},
+	}
+
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out record
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out.Fingerprint == nil || out.Missing != nil {
+		t.Fatalf("Unmarshal(%s) = %+v", data, out)
+	}
+	checkFingerprint(t, "Unmarshal", out.Fingerprint, in.Fingerprint)
+	checkFingerprint(t, "Unmarshal", &out.NotAPointer, &in.NotAPointer)
+
+	// null leaves the fingerprint unchanged.
+	ft := newTestFingerprintWithMetadata()
+	if err := json.Unmarshal([]byte("null"), ft); err != nil {
+		t.Errorf("Unmarshal(null): %v", err)
+	}
+	checkFingerprint(t, "Unmarshal(null)", ft, newTestFingerprintWithMetadata())
+
+	for _, data := range []string{`42`, `"not base64!"`, `"cmF3`} {
+		if err := json.Unmarshal([]byte(data), new(Fingerprint)); err == nil {
+			t.Errorf("Unmarshal(%s): got no error", data)
+		}
+	}
+}
+
+func TestFingerprintValueScan(t *testing.T) {
+	ft := newTestFingerprintWithMetadata()
+
+	v, err := ft.Value()
+	if err != nil {
+		t.Fatalf("Value: %v", err)
+	}
+	data, ok := v.([]byte)
+	if !ok {
+		t.Fatalf("Value returned %T, want []byte", v)
+	}
+
+	for _, src := range []any{data, string(data)} {
+		got := new(Fingerprint)
+		if err := got.Scan(src); err != nil {
+			t.Errorf("Scan(%T): %v", src, err)
+			continue
+		}
+		checkFingerprint(t, "Scan", got, ft)
+	}
+
+	// The scanned fingerprint doesn't share the memory of the source, which
+	// the database driver may reuse.
+	got := new(Fingerprint)
+	src := append([]byte(nil), data...)
+	got.Scan(src)
+	for i := range src {
+		src[i] = 0
+	}
+	checkFingerprint(t, "Scan of a reused buffer", got, ft)
+
+	got = newTestFingerprintWithMetadata()
+	if err := got.Scan(nil); err != nil {
+		t.Errorf("Scan(nil): %v", err)
+	}
+	checkFingerprint(t, "Scan(nil)", got, &Fingerprint{})
+
+	if err := got.Scan(42); err == nil {
+		t.Error("Scan(42): got no error")
+	}
+	if err := got.Scan(data[:len(data)-1]); !errors.Is(err, ErrCorruptFingerprint) {
+		t.Errorf("Scan of a truncated fingerprint: got error %v, want %v", err, ErrCorruptFingerprint)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The fingerprint file format is laid out as follows, all integers are
+// big-endian:
+//
+//	magic             8 bytes
+//	version           1 byte
+//	metadata length   4 bytes
+//	metadata          JSON
+//	payload length    8 bytes
+//	payload           fingerprint as returned by Fingerprint.Dump
+//	checksum          SHA-256 of all the preceding bytes
+const (
+	fingerprintFileMagic   = "\x89PEXFP\r\n"
+	fingerprintFileVersion = 1
+
+	maxFingerprintMetadataSize = 1 << 20
+)
+
+// ErrCorruptFingerprint is returned when reading a fingerprint file that is
+// truncated, damaged or otherwise invalid.
+var ErrCorruptFingerprint = errors.New("corrupt fingerprint")
+
+// FingerprintMetadata describes a fingerprint. It's filled in when the
+// fingerprint is created and stored together with it by Fingerprint.WriteTo
+// and Fingerprint.SaveFile. Raw fingerprints created by NewFingerprint have
+// no metadata.
+type FingerprintMetadata struct {
+	// Types lists the types of fingerprints that were requested.
+	Types FingerprintType
+
+	// SourceSHA256 is the hex-encoded SHA-256 hash of the media the
+	// fingerprint was created from. It's only set for fingerprints of time
+	// ranges (see FingerprintOptions) and by the clients using
+	// WithSourceMetadata or WithFingerprintCache.
+	SourceSHA256 string
+
+	// MediaDuration is the duration of the fingerprinted media (or of the
+	// fingerprinted range, see FingerprintOptions) as reported by
+	// ProbeMedia. It's zero if it's not known or if the client uses neither
+	// WithSourceMetadata nor WithFingerprintCache.
+	MediaDuration time.Duration
+
+	// Offset is the position in the original media file where the
+	// fingerprinted range starts (see FingerprintOptions).
+	Offset time.Duration
+
+	// SDKVersion is the version of the bindings that created the
+	// fingerprint.
+	SDKVersion string
+
+	// CreatedAt is the time the fingerprint was created.
+	CreatedAt time.Time
+}
+
+// fingerprintFileMetadata is the representation of FingerprintMetadata in
+// the fingerprint file and in persisted search futures. It's kept separate
+// so that the formats don't change with the JSON representation of the
+// individual fields.
+type fingerprintFileMetadata struct {
+	Types         int       `json:"types"`
+	SourceSHA256  string    `json:"source_sha256,omitempty"`
+	MediaDuration int64     `json:"media_duration_ns,omitempty"`
+	Offset        int64     `json:"offset_ns,omitempty"`
+	SDKVersion    string    `json:"sdk_version,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newFingerprintFileMetadata(meta FingerprintMetadata) *fingerprintFileMetadata {
+	return &fingerprintFileMetadata{
+		Types:         int(meta.Types),
+		SourceSHA256:  meta.SourceSHA256,
+		MediaDuration: int64(meta.MediaDuration),
+		Offset:        int64(meta.Offset),
+		SDKVersion:    meta.SDKVersion,
+		CreatedAt:     meta.CreatedAt,
+	}
+}
+
+func (x *fingerprintFileMetadata) metadata() FingerprintMetadata {
+	return FingerprintMetadata{
+		Types:         FingerprintType(x.Types),
+		SourceSHA256:  x.SourceSHA256,
+		MediaDuration: time.Duration(x.MediaDuration),
+		Offset:        time.Duration(x.Offset),
+		SDKVersion:    x.SDKVersion,
+		CreatedAt:     x.CreatedAt,
+	}
+}
+
+// WithSourceMetadata makes the client describe the fingerprinted media in
+// FingerprintMetadata: SourceSHA256 and MediaDuration are only set if this
+// option or WithFingerprintCache is used, because the media has to be read
+// and hashed in addition to being fingerprinted.
+func WithSourceMetadata() Option {
+	return func(o *options) {
+		o.sourceMetadata = true
+	}
+}
+
+// newFingerprintMetadata creates the metadata of a fingerprint of the given
+// types created now.
+func newFingerprintMetadata(typ FingerprintType) FingerprintMetadata {
+	return FingerprintMetadata{
+		Types:      typ,
+		SDKVersion: Version().Bindings,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// describeSource hashes the input, which is either a path or the media
+// itself, and determines its duration using ProbeMedia, if possible. It
+// stops reading once the context is done.
+func (x *FingerprintMetadata) describeSource(ctx context.Context, input []byte, isFile bool) error {
+	var r io.ReaderAt
+	var size int64
+	if isFile {
+		f, err := os.Open(string(input))
+		if err != nil {
+			return mediaError(err)
+		}
+		defer f.Close()
+
+		if x.SourceSHA256, size, err = hashContext(ctx, f); err != nil {
+			return err
+		}
+		r = f
+	} else {
+		sum := sha256.Sum256(input)
+		x.SourceSHA256 = hex.EncodeToString(sum[:])
+		r, size = bytes.NewReader(input), int64(len(input))
+	}
+
+	// Media that can't be probed is left for the native library to judge.
+	if info, err := ProbeMedia(r, size); err == nil {
+		x.MediaDuration = info.Duration
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 of the file. It stops reading once the
+// context is done.
+func hashFile(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", mediaError(err)
+	}
+	defer f.Close()
+
+	sum, _, err := hashContext(ctx, f)
+	return sum, err
+}
+
+// hashContext returns the hex-encoded SHA-256 of the media read from r and
+// its size. It stops reading once the context is done.
+func hashContext(ctx context.Context, r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+		return "", 0, mediaError(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// mediaError converts an error of reading the media into an *Error, like the
+// ones returned by the native library when it can't read the media.
+func mediaError(err error) error {
+	code := StatusInvalidInput
+	if errors.Is(err, fs.ErrNotExist) {
+		code = StatusNotFound
+	}
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf("failed to read media: %v", err),
+	}
+}
+
+// WriteTo writes the fingerprint together with its metadata in the
+// versioned fingerprint file format, which can be read by ReadFingerprint.
+func (x *Fingerprint) WriteTo(w io.Writer) (int64, error) {
+	meta, err := json.Marshal(newFingerprintFileMetadata(x.Metadata))
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fingerprintFileMagic)
+	buf.WriteByte(fingerprintFileVersion)
+	binary.Write(&buf, binary.BigEndian, uint32(len(meta)))
+	buf.Write(meta)
+	binary.Write(&buf, binary.BigEndian, uint64(len(x.b)))
+	buf.Write(x.b)
+
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+
+	return buf.WriteTo(w)
+}
+
+// ReadFingerprint reads a fingerprint written by Fingerprint.WriteTo and
+// verifies its checksum. For backwards compatibility, content that doesn't
+// start with the fingerprint file header is treated as a raw fingerprint
+// obtained by Fingerprint.Dump, which has no metadata.
+func ReadFingerprint(r io.Reader) (*Fingerprint, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(fingerprintFileMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if string(magic) != fingerprintFileMagic {
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		return NewFingerprint(b), nil
+	}
+
+	h := sha256.New()
+	tr := io.TeeReader(br, h)
+
+	header := make([]byte, len(fingerprintFileMagic)+1+4)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return nil, corrupt(err)
+	}
+	if v := header[len(fingerprintFileMagic)]; v != fingerprintFileVersion {
+		return nil, fmt.Errorf("unsupported fingerprint file version %d", v)
+	}
+
+	metaSize := binary.BigEndian.Uint32(header[len(fingerprintFileMagic)+1:])
+	if metaSize > maxFingerprintMetadataSize {
+		return nil, corrupt(fmt.Errorf("metadata too large: %d bytes", metaSize))
+	}
+	metaJSON := make([]byte, metaSize)
+	if _, err := io.ReadFull(tr, metaJSON); err != nil {
+		return nil, corrupt(err)
+	}
+
+	var payloadSize uint64
+	if err := binary.Read(tr, binary.BigEndian, &payloadSize); err != nil {
+		return nil, corrupt(err)
+	}
+
+	// Don't trust the size blindly, it might be damaged.
+	var payload bytes.Buffer
+	if n, err := io.CopyN(&payload, tr, int64(payloadSize)); err != nil || uint64(n) != payloadSize {
+		return nil, corrupt(fmt.Errorf("truncated payload: %v", err))
+	}
+
+	want := h.Sum(nil)
+	got := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(br, got); err != nil {
+		return nil, corrupt(err)
+	}
+	if !bytes.Equal(got, want) {
+		return nil, corrupt(errors.New("checksum mismatch"))
+	}
+
+	var meta fingerprintFileMetadata
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return nil, corrupt(err)
+	}
+
+	return &Fingerprint{
+		b:        payload.Bytes(),
+		Metadata: meta.metadata(),
+	}, nil
+}
+
+func corrupt(err error) error {
+	return fmt.Errorf("%w: %v", ErrCorruptFingerprint, err)
+}
+
+// SaveFile writes the fingerprint into a file using WriteTo. The file is
+// replaced atomically, so readers never observe a partially written file.
+// Its permissions are 0644.
+func (x *Fingerprint) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := x.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	// The temporary file is only accessible by the owner.
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadFile reads a fingerprint from a file using ReadFingerprint.
+func LoadFile(path string) (*Fingerprint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadFingerprint(f)
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFingerprintWithMetadata() *Fingerprint {
+	return &Fingerprint{
+		b: []byte("fingerprint"),
+		Metadata: FingerprintMetadata{
+			Types:         FingerprintTypeAudio | FingerprintTypeMelody,
+			SourceSHA256:  "abc",
+			MediaDuration: 90 * time.Second,
+			Offset:        30 * time.Second,
+			SDKVersion:    "4.5",
+			CreatedAt:     time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		},
+	}
+}
+
+func writeTestFingerprint(t *testing.T, ft *Fingerprint) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	n, err := ft.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	return buf.Bytes()
+}
+
+func TestFingerprintFileRoundTrip(t *testing.T) {
+	for _, ft := range []*Fingerprint{newTestFingerprintWithMetadata(), {b: []byte("raw")}, {}} {
+		got, err := ReadFingerprint(bytes.NewReader(writeTestFingerprint(t, ft)))
+		if err != nil {
+			t.Errorf("ReadFingerprint(%q): %v", ft.b, err)
+			continue
+		}
+		if !bytes.Equal(got.b, ft.b) || !reflect.DeepEqual(got.Metadata, ft.Metadata) {
+			t.Errorf("ReadFingerprint = %q, %+v, want %q, %+v", got.b, got.Metadata, ft.b, ft.Metadata)
+		}
+	}
+}
+
+func TestReadFingerprintCorrupt(t *testing.T) {
+	data := writeTestFingerprint(t, newTestFingerprintWithMetadata())
+	payload := bytes.Index(data, []byte("fingerprint"))
+
+	flipped := append([]byte(nil), data...)
+	flipped[payload] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"checksum mismatch", flipped},
+		{"truncated header", data[:len(fingerprintFileMagic)+2]},
+		{"truncated metadata", data[:len(fingerprintFileMagic)+10]},
+		{"truncated payload", data[:payload+4]},
+		{"truncated checksum", data[:len(data)-1]},
+	}
+	for _, tt := range tests {
+		if _, err := ReadFingerprint(bytes.NewReader(tt.data)); !errors.Is(err, ErrCorruptFingerprint) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, ErrCorruptFingerprint)
+		}
+	}
+}
+
+func TestReadFingerprintUnknownVersion(t *testing.T) {
+	data := writeTestFingerprint(t, newTestFingerprintWithMetadata())
+	data[len(fingerprintFileMagic)] = fingerprintFileVersion + 1
+
+	_, err := ReadFingerprint(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "unsupported fingerprint file version") {
+		t.Errorf("got error %v, want an unsupported version", err)
+	}
+}
+
+func TestReadFingerprintRaw(t *testing.T) {
+	// Raw dumps, including ones shorter than the header, are read as they
+	// are.
+	for _, raw := range []string{"", "raw", "raw fingerprint longer than the header"} {
+		ft, err := ReadFingerprint(strings.NewReader(raw))
+		if err != nil {
+			t.Errorf("ReadFingerprint(%q): %v", raw, err)
+			continue
+		}
+		if string(ft.Dump()) != raw || ft.Metadata != (FingerprintMetadata{}) {
+			t.Errorf("ReadFingerprint(%q) = %q, %+v, want the raw fingerprint", raw, ft.Dump(), ft.Metadata)
+		}
+	}
+}
+
+func TestSaveFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ft")
+	ft := newTestFingerprintWithMetadata()
+
+	for i := 0; i < 2; i++ {
+		if err := ft.SaveFile(path); err != nil {
+			t.Fatalf("SaveFile: %v", err)
+		}
+	}
+
+	got, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if !bytes.Equal(got.b, ft.b) || !reflect.DeepEqual(got.Metadata, ft.Metadata) {
+		t.Errorf("LoadFile = %q, %+v, want %q, %+v", got.b, got.Metadata, ft.b, ft.Metadata)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o644 {
+		t.Errorf("got permissions %v, want %v", perm, os.FileMode(0o644))
+	}
+	checkDirEntries(t, dir, "ft")
+
+	if _, err := LoadFile(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadFile of a missing file: got error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestSaveFileFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	// The file can't replace a non-empty directory.
+	path := filepath.Join(dir, "ft")
+	writeTree(t, dir, "ft/other")
+
+	if err := newTestFingerprintWithMetadata().SaveFile(path); err == nil {
+		t.Fatal("SaveFile: got no error")
+	}
+	checkDirEntries(t, dir, "ft")
+}
+
+// checkDirEntries checks that dir contains exactly the given entries.
+func checkDirEntries(t *testing.T, dir string, want ...string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s contains %q, want %q", dir, got, want)
+	}
+}
+
+func TestDescribeSource(t *testing.T) {
+	media := adtsStream(16)
+	sum := sha256.Sum256(media)
+	wantSum := hex.EncodeToString(sum[:])
+
+	path := filepath.Join(t.TempDir(), "media.aac")
+	if err := os.WriteFile(path, media, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, isFile := range []bool{true, false} {
+		input := media
+		if isFile {
+			input = []byte(path)
+		}
+
+		meta := newFingerprintMetadata(FingerprintTypeAudio)
+		if err := meta.describeSource(context.Background(), input, isFile); err != nil {
+			t.Errorf("file %v: got error %v", isFile, err)
+			continue
+		}
+		if meta.SourceSHA256 != wantSum || meta.MediaDuration != 2048*time.Millisecond {
+			t.Errorf("file %v: got %+v, want the hash and a duration of 2.048s", isFile, meta)
+		}
+	}
+
+	meta := newFingerprintMetadata(FingerprintTypeAudio)
+	err := meta.describeSource(context.Background(), []byte(path+".missing"), true)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != StatusNotFound {
+		t.Errorf("missing file: got error %v, want StatusNotFound", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := meta.describeSource(ctx, []byte(path), true); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled context: got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// FingerprintOptions specify which part of a media file is fingerprinted
+// and how.
+type FingerprintOptions struct {
+	// Types specifies which types of fingerprints to create. If empty,
+	// FingerprintTypeAll is assumed.
+	Types []FingerprintType
+
+	// Start is the beginning of the fingerprinted range.
+	Start time.Duration
+
+	// End is the end of the fingerprinted range. Zero means the end of the
+	// media.
+	End time.Duration
+}
+
+func (x *FingerprintOptions) validate() error {
+	if err := validateRange(x.Start, x.End); err != nil {
+		return err
+	}
+	return validateTypes(x.Types)
+}
+
+func (x *FingerprintOptions) isRange() bool {
+	return x.Start != 0 || x.End != 0
+}
+
+// WithFFmpegPath sets the path to the ffmpeg binary used to extract time
+// ranges of media files (see FingerprintOptions). By default, ffmpeg is
+// looked up in the directories listed in the PATH environment variable, see
+// VersionInfo.FFmpeg. The binary must include the aac encoder, and the
+// libx264 encoder to extract ranges for video fingerprints.
+func WithFFmpegPath(path string) Option {
+	return func(o *options) {
+		o.ffmpegPath = path
+	}
+}
+
+// FingerprintFileWithOptions is like FingerprintFileContext, but allows to
+// fingerprint only a time range of the file. The native library always
+// processes whole files, so the range is first extracted into a temporary
+// file using ffmpeg, which must be installed (see WithFFmpegPath). The range
+// is re-encoded, so that it starts exactly at Start rather than at the key
+// frame preceding it. The video is only kept if FingerprintTypeVideo is
+// requested, because encoding it is considerably more expensive.
+//
+// The start of the range is recorded in the fingerprint (see
+// Fingerprint.Offset), so that the query segments returned by the search
+// can be mapped back to the positions in the original file using ShiftQuery.
+func (x *fingerprinter) FingerprintFileWithOptions(ctx context.Context, path string, opts FingerprintOptions) (*Fingerprint, error) {
+	return fingerprintFileWithOptions(ctx, x, x.opts.ffmpegPath, path, opts)
+}
+
+// FingerprintBufferWithOptions is like FingerprintFileWithOptions, but
+// fingerprints a media file loaded in memory. The buffer is written into a
+// temporary file if a range is requested.
+func (x *fingerprinter) FingerprintBufferWithOptions(ctx context.Context, buffer []byte, opts FingerprintOptions) (*Fingerprint, error) {
+	return fingerprintBufferWithOptions(ctx, x, x.opts.ffmpegPath, buffer, opts)
+}
+
+// fingerprintFileWithOptions implements FingerprintFileWithOptions on top of
+// any Fingerprinter.
+func fingerprintFileWithOptions(ctx context.Context, fp Fingerprinter, ffmpeg, path string, opts FingerprintOptions) (*Fingerprint, error) {
+	if err := validatePath(path); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if !opts.isRange() {
+		return fp.FingerprintFileContext(ctx, path, opts.Types...)
+	}
+	return fingerprintRange(ctx, fp, ffmpeg, path, "", opts)
+}
+
+func fingerprintBufferWithOptions(ctx context.Context, fp Fingerprinter, ffmpeg string, buffer []byte, opts FingerprintOptions) (*Fingerprint, error) {
+	if err := validateBuffer(buffer); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if !opts.isRange() {
+		return fp.FingerprintBufferContext(ctx, buffer, opts.Types...)
+	}
+
+	in, err := spool(buffer, bytes.NewReader(nil), int64(len(buffer)))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in)
+
+	sum := sha256.Sum256(buffer)
+	return fingerprintRange(ctx, fp, ffmpeg, in, hex.EncodeToString(sum[:]), opts)
+}
+
+// fingerprintRange fingerprints the range of the file given by opts. The
+// sum is the SHA-256 of the file, it's computed from the file if empty.
+func fingerprintRange(ctx context.Context, fp Fingerprinter, ffmpeg, path, sum string, opts FingerprintOptions) (*Fingerprint, error) {
+	video := reduceTypes(opts.Types).Has(FingerprintTypeVideo)
+	out, err := extractRange(ctx, ffmpeg, path, opts.Start, opts.End, video)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out)
+
+	ft, err := fp.FingerprintFileContext(ctx, out, opts.Types...)
+	if err != nil {
+		return nil, err
+	}
+	// The fingerprint describes the original file, not the extracted range.
+	if sum == "" {
+		if sum, err = hashFile(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+	ft.Metadata.SourceSHA256 = sum
+	ft.Metadata.Offset = opts.Start
+	return ft, nil
+}
+
+// extractRange re-encodes the given time range of the input file into a new
+// temporary MP4 file and returns its path. Unlike copying the streams,
+// re-encoding makes ffmpeg seek accurately. The first audio stream is always
+// kept, the first video stream only if requested.
+func extractRange(ctx context.Context, ffmpeg, input string, start, end time.Duration, video bool) (string, error) {
+	if ffmpeg == "" {
+		var err error
+		if ffmpeg, err = exec.LookPath("ffmpeg"); err != nil {
+			return "", fmt.Errorf("fingerprinting a time range requires ffmpeg: %w", err)
+		}
+	}
+
+	f, err := os.CreateTemp("", "pex-range-*.mp4")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	out := f.Name()
+	f.Close()
+
+	args := []string{"-nostdin", "-loglevel", "error", "-y", "-ss", formatSeconds(start)}
+	if end != 0 {
+		args = append(args, "-to", formatSeconds(end))
+	}
+	args = append(args, "-i", input, "-map", "0:a:0?", "-c:a", "aac")
+	if video {
+		args = append(args, "-map", "0:v:0?", "-c:v", "libx264", "-preset", "veryfast")
+	}
+	args = append(args, "-f", "mp4", out)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(out)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("failed to extract range %v-%v: %w: %s", start, end, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// ShiftQuery moves the query part of the segment by the given offset,
+// rounded to the nearest second, since the segments are in whole seconds.
+func (x *Segment) ShiftQuery(offset time.Duration) {
+	secs := offsetSeconds(offset)
+	x.QueryStart += secs
+	x.QueryEnd += secs
+}
+
+// offsetSeconds rounds the offset to whole seconds.
+func offsetSeconds(offset time.Duration) int64 {
+	return int64(offset.Round(time.Second) / time.Second)
+}
+
+// ShiftQuery moves the query part of all the segments by the given offset.
+func (x *MatchDetails) ShiftQuery(offset time.Duration) {
+	for _, d := range []*SegmentDetails{x.Audio, x.Melody, x.Video, x.Phonetic} {
+		if d == nil {
+			continue
+		}
+		for i := range d.Segments {
+			d.Segments[i].ShiftQuery(offset)
+		}
+	}
+}
+
+// ShiftQuery moves the query part of all the matched segments by the given
+// offset. It's used to map the segments of a search performed using a
+// fingerprint of a time range back to the positions in the original file:
+//
+//	res.ShiftQuery(ft.Offset())
+func (x *PexSearchResult) ShiftQuery(offset time.Duration) {
+	for _, m := range x.Matches {
+		m.MatchDetails.ShiftQuery(offset)
+	}
+}
+
+// ShiftQuery moves the query part of all the matched segments by the given
+// offset. See PexSearchResult.ShiftQuery for details.
+func (x *PrivateSearchResult) ShiftQuery(offset time.Duration) {
+	for _, m := range x.Matches {
+		if m.MatchDetails != nil {
+			m.MatchDetails.ShiftQuery(offset)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprintOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    FingerprintOptions
+		wantErr bool
+	}{
+		{FingerprintOptions{}, false},
+		{FingerprintOptions{Start: time.Second}, false},
+		{FingerprintOptions{End: time.Second}, false},
+		{FingerprintOptions{Start: time.Second, End: 2 * time.Second}, false},
+		{FingerprintOptions{Types: []FingerprintType{FingerprintTypeAudio}, End: time.Second}, false},
+		{FingerprintOptions{Start: -time.Second}, true},
+		{FingerprintOptions{Start: time.Second, End: time.Second}, true},
+		{FingerprintOptions{Start: 2 * time.Second, End: time.Second}, true},
+		{FingerprintOptions{Types: []FingerprintType{0}}, true},
+	}
+	for _, tt := range tests {
+		checkValidateError(t, "validate", tt.opts.validate(), tt.wantErr)
+	}
+}
+
+func TestFormatSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "1.5"},
+		{time.Millisecond, "0.001"},
+		{time.Hour + time.Microsecond, "3600.000001"},
+	}
+	for _, tt := range tests {
+		if got := formatSeconds(tt.d); got != tt.want {
+			t.Errorf("formatSeconds(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestShiftQuery(t *testing.T) {
+	tests := []struct {
+		offset time.Duration
+		want   int64
+	}{
+		{0, 0},
+		{time.Second, 1},
+		{1499 * time.Millisecond, 1},
+		{1500 * time.Millisecond, 2},
+		{90 * time.Second, 90},
+	}
+	for _, tt := range tests {
+		s := Segment{QueryStart: 10, QueryEnd: 20, AssetStart: 30, AssetEnd: 40}
+		s.ShiftQuery(tt.offset)
+		want := Segment{QueryStart: 10 + tt.want, QueryEnd: 20 + tt.want, AssetStart: 30, AssetEnd: 40}
+		if s != want {
+			t.Errorf("ShiftQuery(%v) = %+v, want %+v", tt.offset, s, want)
+		}
+	}
+
+	// Missing details and matches without details are skipped.
+	res := &PrivateSearchResult{Matches: []*PrivateSearchMatch{
+		{},
+		{MatchDetails: &MatchDetails{Video: &SegmentDetails{Segments: []Segment{{QueryStart: 1, QueryEnd: 2}}}}},
+	}}
+	res.ShiftQuery(3 * time.Second)
+	if got := res.Matches[1].MatchDetails.Video.Segments[0]; got.QueryStart != 4 || got.QueryEnd != 5 {
+		t.Errorf("ShiftQuery(3s) = %+v, want the query shifted to [4, 5]", got)
+	}
+}
+
+// fakeFFmpeg writes a script that copies the input to the output instead of
+// extracting the range and records its arguments into the returned file.
+func fakeFFmpeg(t *testing.T) (ffmpeg, args string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	ffmpeg = filepath.Join(dir, "ffmpeg")
+	args = filepath.Join(dir, "args")
+
+	script := `#!/bin/sh
+echo "$@" > ` + args + `
+while [ $# -gt 1 ]; do
+	if [ "$1" = -i ]; then in=$2; fi
+	shift
+done
+cp "$in" "$1"
+`
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return ffmpeg, args
+}
+
+func TestFingerprintRange(t *testing.T) {
+	ffmpeg, argsFile := fakeFFmpeg(t)
+
+	media := []byte("media")
+	sum := sha256.Sum256(media)
+	wantSum := hex.EncodeToString(sum[:])
+
+	path := filepath.Join(t.TempDir(), "media")
+	if err := os.WriteFile(path, media, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := FingerprintOptions{
+		Types: []FingerprintType{FingerprintTypeAudio},
+		Start: 1500 * time.Millisecond,
+		End:   3 * time.Second,
+	}
+	fingerprint := map[string]func(Fingerprinter) (*Fingerprint, error){
+		"file": func(fp Fingerprinter) (*Fingerprint, error) {
+			return fingerprintFileWithOptions(context.Background(), fp, ffmpeg, path, opts)
+		},
+		"buffer": func(fp Fingerprinter) (*Fingerprint, error) {
+			return fingerprintBufferWithOptions(context.Background(), fp, ffmpeg, media, opts)
+		},
+	}
+	for name, f := range fingerprint {
+		fp := new(recordingFingerprinter)
+		ft, err := f(fp)
+		if err != nil {
+			t.Errorf("%s: got error %v", name, err)
+			continue
+		}
+
+		if string(fp.data) != string(media) {
+			t.Errorf("%s: fingerprinted %q, want %q", name, fp.data, media)
+		}
+		if _, err := os.Stat(fp.path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: extracted range not removed: %v", name, err)
+		}
+		if ft.Metadata.SourceSHA256 != wantSum {
+			t.Errorf("%s: got SourceSHA256 %q, want %q", name, ft.Metadata.SourceSHA256, wantSum)
+		}
+		if ft.Metadata.Offset != opts.Start {
+			t.Errorf("%s: got offset %v, want %v", name, ft.Metadata.Offset, opts.Start)
+		}
+
+		args, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(args), "-ss 1.5 -to 3 ") || strings.Contains(string(args), "libx264") {
+			t.Errorf("%s: ffmpeg called with %s", name, args)
+		}
+	}
+}
+
+func TestFingerprintRangeWithoutRange(t *testing.T) {
+	// Without a range, the media is fingerprinted directly.
+	fp := new(recordingFingerprinter)
+	_, err := fingerprintBufferWithOptions(context.Background(), fp, "/nonexistent/ffmpeg", []byte("media"), FingerprintOptions{})
+	if err != nil || fp.path != "" || string(fp.data) != "media" {
+		t.Errorf("got %q from %q, %v, want the buffer fingerprinted", fp.data, fp.path, err)
+	}
+}
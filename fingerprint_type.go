@@ -0,0 +1,155 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// FingerprintType is a bit flag specifying one or more fingerprint types.
+//
+// FingerprintTypeAll covers the types used for audio matching and is used
+// whenever no types are given. FingerprintTypeVideo and
+// FingerprintTypeClassification are not part of it and must be requested
+// explicitly: video fingerprints are considerably more expensive to create
+// and search, and classification fingerprints aren't used for matching at
+// all, only for content classification. FingerprintTypeAll can't be
+// extended without changing the behavior of existing code, so it keeps its
+// historical meaning.
+type FingerprintType int
+
+const (
+	FingerprintTypeVideo          FingerprintType = 1
+	FingerprintTypeAudio          FingerprintType = 2
+	FingerprintTypeMelody         FingerprintType = 4
+	FingerprintTypePhonetic       FingerprintType = 8
+	FingerprintTypeClassification FingerprintType = 16
+	FingerprintTypeAll                            = FingerprintTypeAudio | FingerprintTypeMelody | FingerprintTypePhonetic
+
+	fingerprintTypeKnown = FingerprintTypeVideo | FingerprintTypeAudio | FingerprintTypeMelody |
+		FingerprintTypePhonetic | FingerprintTypeClassification
+)
+
+var _ flag.Value = (*FingerprintType)(nil)
+
+// fingerprintTypeNames are the names used by the API, ordered by the bit
+// value.
+var fingerprintTypeNames = []struct {
+	typ  FingerprintType
+	name string
+}{
+	{FingerprintTypeVideo, "video"},
+	{FingerprintTypeAudio, "audio"},
+	{FingerprintTypeMelody, "melody"},
+	{FingerprintTypePhonetic, "phonetic"},
+	{FingerprintTypeClassification, "class"},
+}
+
+// ParseFingerprintType parses one or more fingerprint type names separated
+// by commas or "|", e.g. "audio,melody". The names are the ones used by the
+// API ("video", "audio", "melody", "phonetic" and "class"), and "all" stands
+// for FingerprintTypeAll. It's the inverse of FingerprintType.String.
+func ParseFingerprintType(s string) (FingerprintType, error) {
+	var out FingerprintType
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '|' }) {
+		t, ok := parseFingerprintTypeName(strings.ToLower(strings.TrimSpace(name)))
+		if !ok {
+			return 0, fmt.Errorf("invalid fingerprint type %q", name)
+		}
+		out |= t
+	}
+	if out == 0 {
+		return 0, fmt.Errorf("invalid fingerprint type %q", s)
+	}
+	return out, nil
+}
+
+func parseFingerprintTypeName(name string) (FingerprintType, bool) {
+	if name == "all" {
+		return FingerprintTypeAll, true
+	}
+	for _, n := range fingerprintTypeNames {
+		if n.name == name {
+			return n.typ, true
+		}
+	}
+	return 0, false
+}
+
+// String returns the names of the types joined by "|", e.g.
+// "audio|melody". Unknown bits are formatted as numbers.
+func (x FingerprintType) String() string {
+	if x == 0 {
+		return "none"
+	}
+
+	var names []string
+	for _, t := range x.Split() {
+		name := fmt.Sprintf("FingerprintType(%d)", int(t))
+		for _, n := range fingerprintTypeNames {
+			if n.typ == t {
+				name = n.name
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "|")
+}
+
+// Has reports whether x contains all the types in t.
+func (x FingerprintType) Has(t FingerprintType) bool {
+	return t != 0 && x&t == t
+}
+
+// Split returns the individual types contained in x, ordered by their bit
+// value.
+func (x FingerprintType) Split() []FingerprintType {
+	var out []FingerprintType
+	for v := uint(x); v != 0; v &= v - 1 {
+		out = append(out, FingerprintType(1)<<bits.TrailingZeros(v))
+	}
+	return out
+}
+
+// Set implements flag.Value. It replaces the value with the result of
+// ParseFingerprintType, so that a flag can be defined as:
+//
+//	types := pex.FingerprintTypeAll
+//	flag.Var(&types, "types", "fingerprint types, e.g. audio,melody")
+func (x *FingerprintType) Set(s string) error {
+	t, err := ParseFingerprintType(s)
+	if err != nil {
+		return err
+	}
+	*x = t
+	return nil
+}
+
+// MarshalJSON encodes the type as a string, see String. A single type is
+// encoded using the same name the API uses.
+func (x FingerprintType) MarshalJSON() ([]byte, error) {
+	if x <= 0 || x&^fingerprintTypeKnown != 0 {
+		return nil, fmt.Errorf("invalid fingerprint type %d", int(x))
+	}
+	return json.Marshal(x.String())
+}
+
+func (x *FingerprintType) UnmarshalJSON(data []byte) error {
+	var temp string
+	if err := json.Unmarshal(data, &temp); err != nil {
+		return err
+	}
+
+	t, err := ParseFingerprintType(temp)
+	if err != nil {
+		return errors.New("invalid fingerprint_type value")
+	}
+	*x = t
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"encoding/json"
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestParseFingerprintType(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    FingerprintType
+		wantErr bool
+	}{
+		{"audio", FingerprintTypeAudio, false},
+		{"class", FingerprintTypeClassification, false},
+		{"audio,melody", FingerprintTypeAudio | FingerprintTypeMelody, false},
+		{"audio|melody", FingerprintTypeAudio | FingerprintTypeMelody, false},
+		{" Video , PHONETIC ", FingerprintTypeVideo | FingerprintTypePhonetic, false},
+		{"all", FingerprintTypeAll, false},
+		{"all,video", FingerprintTypeAll | FingerprintTypeVideo, false},
+		{"audio,audio", FingerprintTypeAudio, false},
+		{"", 0, true},
+		{",", 0, true},
+		{"none", 0, true},
+		{"audio,foo", 0, true},
+		{"2", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFingerprintType(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFingerprintType(%q): got error %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseFingerprintType(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintTypeString(t *testing.T) {
+	tests := []struct {
+		in   FingerprintType
+		want string
+	}{
+		{0, "none"},
+		{FingerprintTypeVideo, "video"},
+		{FingerprintTypeClassification, "class"},
+		{FingerprintTypeAll, "audio|melody|phonetic"},
+		{FingerprintTypeMelody | FingerprintTypeVideo, "video|melody"},
+		{FingerprintTypeAudio | 64, "audio|FingerprintType(64)"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("FingerprintType(%d).String() = %q, want %q", int(tt.in), got, tt.want)
+		}
+	}
+
+	// String and ParseFingerprintType are inverse for known types.
+	for x := FingerprintType(1); x <= fingerprintTypeKnown; x++ {
+		got, err := ParseFingerprintType(x.String())
+		if err != nil || got != x {
+			t.Errorf("ParseFingerprintType(%q) = %v, %v, want %v", x.String(), got, err, x)
+		}
+	}
+}
+
+func TestFingerprintTypeSplit(t *testing.T) {
+	tests := []struct {
+		in   FingerprintType
+		want []FingerprintType
+	}{
+		{0, nil},
+		{FingerprintTypeAudio, []FingerprintType{FingerprintTypeAudio}},
+		{FingerprintTypeAll, []FingerprintType{FingerprintTypeAudio, FingerprintTypeMelody, FingerprintTypePhonetic}},
+		{FingerprintTypeClassification | FingerprintTypeVideo, []FingerprintType{FingerprintTypeVideo, FingerprintTypeClassification}},
+	}
+	for _, tt := range tests {
+		if got := tt.in.Split(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FingerprintType(%d).Split() = %v, want %v", int(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintTypeHas(t *testing.T) {
+	tests := []struct {
+		x, t FingerprintType
+		want bool
+	}{
+		{FingerprintTypeAll, FingerprintTypeAudio, true},
+		{FingerprintTypeAll, FingerprintTypeAudio | FingerprintTypeMelody, true},
+		{FingerprintTypeAll, FingerprintTypeVideo, false},
+		{FingerprintTypeAll, FingerprintTypeAudio | FingerprintTypeVideo, false},
+		{FingerprintTypeAll, 0, false},
+		{0, 0, false},
+	}
+	for _, tt := range tests {
+		if got := tt.x.Has(tt.t); got != tt.want {
+			t.Errorf("%v.Has(%v) = %v, want %v", tt.x, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintTypeSet(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	types := FingerprintTypeAll
+	fs.Var(&types, "types", "")
+
+	if err := fs.Parse([]string{"-types", "video,class"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if want := FingerprintTypeVideo | FingerprintTypeClassification; types != want {
+		t.Errorf("types = %v, want %v", types, want)
+	}
+
+	if err := types.Set("foo"); err == nil {
+		t.Error("Set(\"foo\"): got no error")
+	}
+	if want := FingerprintTypeVideo | FingerprintTypeClassification; types != want {
+		t.Errorf("types = %v after a failed Set, want %v", types, want)
+	}
+}
+
+func TestFingerprintTypeJSON(t *testing.T) {
+	for x := FingerprintType(1); x <= fingerprintTypeKnown; x++ {
+		data, err := json.Marshal(x)
+		if err != nil {
+			t.Errorf("Marshal(%d): %v", int(x), err)
+			continue
+		}
+
+		var got FingerprintType
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", data, err)
+			continue
+		}
+		if got != x {
+			t.Errorf("Unmarshal(%s) = %v, want %v", data, got, x)
+		}
+	}
+
+	if data, err := json.Marshal(FingerprintTypeAudio); err != nil || string(data) != `"audio"` {
+		t.Errorf("Marshal(FingerprintTypeAudio) = %s, %v, want \"audio\"", data, err)
+	}
+
+	for _, x := range []FingerprintType{0, -1, 64, FingerprintTypeAudio | 64} {
+		if _, err := json.Marshal(x); err == nil {
+			t.Errorf("Marshal(%d): got no error", int(x))
+		}
+	}
+
+	for _, data := range []string{`""`, `"foo"`, `2`, `null`} {
+		var got FingerprintType
+		if err := json.Unmarshal([]byte(data), &got); err == nil {
+			t.Errorf("Unmarshal(%s): got no error", data)
+		}
+	}
+}
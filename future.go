@@ -0,0 +1,250 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults used by PollPolicy.
+const (
+	DefaultPollInterval    = 500 * time.Millisecond
+	DefaultMaxPollInterval = 10 * time.Second
+	DefaultMaxPollDuration = 30 * time.Minute
+)
+
+// PollPolicy specifies how the search futures poll for the result. A future
+// checks the search again after an interval only if the result is not ready
+// yet, i.e. the check fails with StatusLookupTimedOut. Other errors end the
+// polling; the retryable ones are retried by the check itself according to
+// the RetryPolicy of the client.
+type PollPolicy struct {
+	// Interval is the delay before the first repeated check. It's doubled
+	// after every subsequent check. It defaults to DefaultPollInterval.
+	Interval time.Duration
+
+	// MaxInterval caps the delay between two checks. It defaults to
+	// DefaultMaxPollInterval.
+	MaxInterval time.Duration
+
+	// MaxDuration limits the total time spent polling, after which the
+	// future fails with StatusDeadlineExceeded. It defaults to
+	// DefaultMaxPollDuration.
+	MaxDuration time.Duration
+}
+
+// WithPollPolicy sets the policy used by the futures returned by
+// StartSearch.
+func WithPollPolicy(policy PollPolicy) Option {
+	return func(o *options) {
+		o.pollPolicy = policy
+	}
+}
+
+func (x PollPolicy) withDefaults() PollPolicy {
+	if x.Interval <= 0 {
+		x.Interval = DefaultPollInterval
+	}
+	if x.MaxInterval <= 0 {
+		x.MaxInterval = DefaultMaxPollInterval
+	}
+	if x.MaxDuration <= 0 {
+		x.MaxDuration = DefaultMaxPollDuration
+	}
+	return x
+}
+
+// future implements the search futures. The polling starts when the
+// future is used for the first time and continues in the background until
+// the result is retrieved, an error other than "not ready" occurs, the
+// policy's MaxDuration elapses or the future is canceled. The outcome is
+// kept, so that all the calls observe the same one.
+type future[T any] struct {
+	check  func(ctx context.Context) (T, error)
+	policy PollPolicy
+
+	startOnce sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// Written before done is closed.
+	res T
+	err error
+}
+
+func newFuture[T any](check func(ctx context.Context) (T, error), policy PollPolicy) *future[T] {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &future[T]{
+		check:  check,
+		policy: policy.withDefaults(),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+func (x *future[T]) start() {
+	x.startOnce.Do(func() {
+		go x.poll()
+	})
+}
+
+func (x *future[T]) poll() {
+	defer close(x.done)
+	defer x.cancel()
+
+	ctx, cancel := context.WithTimeout(x.ctx, x.policy.MaxDuration)
+	defer cancel()
+
+	interval := x.policy.Interval
+	for {
+		if x.err = x.stopped(ctx); x.err != nil {
+			return
+		}
+
+		res, err := x.check(ctx)
+		if err == nil {
+			x.res = res
+			return
+		}
+		if !isNotReady(err) {
+			if x.err = x.stopped(ctx); x.err == nil {
+				x.err = err
+			}
+			return
+		}
+
+		sleepContext(ctx, interval)
+		if interval *= 2; interval > x.policy.MaxInterval {
+			interval = x.policy.MaxInterval
+		}
+	}
+}
+
+// stopped returns the error the future fails with if it was canceled or if
+// ctx, bounded by the policy's MaxDuration, is done.
+func (x *future[T]) stopped(ctx context.Context) error {
+	switch {
+	case x.ctx.Err() != nil:
+		return context.Canceled
+	case ctx.Err() != nil:
+		return &Error{
+			Code:    StatusDeadlineExceeded,
+			Message: fmt.Sprintf("search result not ready after %v", x.policy.MaxDuration),
+		}
+	}
+	return nil
+}
+
+// isNotReady reports whether a check of a search failed because the result
+// is not ready yet.
+func isNotReady(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == StatusLookupTimedOut
+}
+
+// closedChan is returned by Done of futures that were never started.
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// errUnstartedFuture is returned by the zero-value futures, which can't
+// poll for anything.
+func errUnstartedFuture() error {
+	return errInvalidInput("search future not started, use StartSearch or ResumeSearch")
+}
+
+// The methods below can be called on a nil future, which is how the
+// zero-value search futures, e.g. ones decoded using json.Unmarshal, are
+// represented. They fail right away.
+
+func (x *future[T]) Done() <-chan struct{} {
+	if x == nil {
+		return closedChan
+	}
+	x.start()
+	return x.done
+}
+
+func (x *future[T]) Wait(ctx context.Context) error {
+	if x == nil {
+		return errUnstartedFuture()
+	}
+	select {
+	case <-x.Done():
+		return x.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (x *future[T]) GetContext(ctx context.Context) (T, error) {
+	if err := x.Wait(ctx); err != nil {
+		var zero T
+		return zero, err
+	}
+	return x.res, nil
+}
+
+func (x *future[T]) TryGet() (T, bool, error) {
+	if x == nil {
+		var zero T
+		return zero, true, errUnstartedFuture()
+	}
+	select {
+	case <-x.Done():
+		return x.res, true, x.err
+	default:
+		var zero T
+		return zero, false, nil
+	}
+}
+
+func (x *future[T]) Cancel() {
+	if x == nil {
+		return
+	}
+	x.cancel()
+	x.start()
+}
+
+// Kinds of persisted search futures.
+const (
+	searchKindPex     = "pex"
+	searchKindPrivate = "private"
+)
+
+// persistedFuture is the JSON representation of the search futures, see
+// PexSearchFuture.MarshalJSON.
+type persistedFuture struct {
+	Kind        string                   `json:"kind"`
+	LookupIDs   []string                 `json:"lookup_ids"`
+	SearchType  PexSearchType            `json:"search_type,omitempty"`
+	StartedAt   time.Time                `json:"started_at"`
+	Fingerprint *fingerprintFileMetadata `json:"fingerprint,omitempty"`
+}
+
+func unmarshalFuture(data []byte, kind string) (*persistedFuture, error) {
+	var p persistedFuture
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errInvalidInput("invalid search future: %v", err)
+	}
+	if p.Kind != kind {
+		return nil, errInvalidInput("can't resume a %q search as a %q search", p.Kind, kind)
+	}
+	if err := validateLookupIDs(p.LookupIDs); err != nil {
+		return nil, err
+	}
+	if p.Fingerprint == nil {
+		p.Fingerprint = new(fingerprintFileMetadata)
+	}
+	return &p, nil
+}
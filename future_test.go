@@ -0,0 +1,205 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testPollPolicy = PollPolicy{
+	Interval:    time.Millisecond,
+	MaxInterval: 2 * time.Millisecond,
+	MaxDuration: time.Second,
+}
+
+func TestFuturePoll(t *testing.T) {
+	notReady := &Error{Code: StatusLookupTimedOut, IsRetryable: true}
+	retryable := &Error{Code: StatusConnectionError, IsRetryable: true}
+	fail := errors.New("fail")
+
+	tests := []struct {
+		name     string
+		errs     []error // returned by the consecutive checks
+		wantErr  error
+		wantCall int
+	}{
+		{"ready", []error{nil}, nil, 1},
+		{"not ready", []error{notReady, notReady, nil}, nil, 3},
+		{"retryable error", []error{notReady, retryable, nil}, retryable, 2},
+		{"other error", []error{fail}, fail, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			f := newFuture(func(ctx context.Context) (int, error) {
+				err := tt.errs[calls]
+				calls++
+				if err != nil {
+					return 0, err
+				}
+				return 42, nil
+			}, testPollPolicy)
+
+			res, err := f.GetContext(context.Background())
+			if tt.wantErr != nil && err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && res != 42 {
+				t.Errorf("got result %d, want 42", res)
+			}
+			if calls != tt.wantCall {
+				t.Errorf("got %d checks, want %d", calls, tt.wantCall)
+			}
+		})
+	}
+}
+
+func TestFuturePollMaxDuration(t *testing.T) {
+	policy := testPollPolicy
+	policy.MaxDuration = 20 * time.Millisecond
+
+	f := newFuture(func(ctx context.Context) (int, error) {
+		return 0, &Error{Code: StatusLookupTimedOut, IsRetryable: true}
+	}, policy)
+
+	_, err := f.GetContext(context.Background())
+	var e *Error
+	if !errors.As(err, &e) || e.Code != StatusDeadlineExceeded {
+		t.Errorf("got error %v, want StatusDeadlineExceeded", err)
+	}
+}
+
+func TestFutureCancel(t *testing.T) {
+	started := make(chan struct{})
+	f := newFuture(func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}, testPollPolicy)
+
+	f.start()
+	<-started
+	f.Cancel()
+
+	if _, err := f.GetContext(context.Background()); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// The outcome is kept.
+	if _, ok, err := f.TryGet(); !ok || err != context.Canceled {
+		t.Errorf("TryGet = %v, %v, want true, %v", ok, err, context.Canceled)
+	}
+}
+
+func TestZeroValueFuture(t *testing.T) {
+	var fut PexSearchFuture
+	if err := json.Unmarshal([]byte(`{"kind":"pex","lookup_ids":["a"]}`), &fut); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	var e *Error
+	if _, err := fut.Get(); !errors.As(err, &e) || e.Code != StatusInvalidInput {
+		t.Errorf("Get: got error %v, want StatusInvalidInput", err)
+	}
+	if _, ok, err := fut.TryGet(); !ok || err == nil {
+		t.Errorf("TryGet = %v, %v, want true and an error", ok, err)
+	}
+	select {
+	case <-fut.Done():
+	default:
+		t.Error("Done: channel not closed")
+	}
+	fut.Cancel()
+
+	var private PrivateSearchFuture
+	if _, err := private.Get(); !errors.As(err, &e) || e.Code != StatusInvalidInput {
+		t.Errorf("Get: got error %v, want StatusInvalidInput", err)
+	}
+}
+
+// newClosedTestClient returns a client that can't reach the native library.
+// The futures resumed using it fail with ErrClientClosed once they poll.
+func newClosedTestClient() fingerprinter {
+	return fingerprinter{&client{opts: newOptions([]Option{WithPollPolicy(testPollPolicy)}), closed: true}}
+}
+
+func TestResumeSearch(t *testing.T) {
+	meta := newTestFingerprintWithMetadata().Metadata
+	startedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	pexClient := &PexSearchClient{newClosedTestClient()}
+	pexFut := &PexSearchFuture{
+		LookupIDs:           []string{"a", "b"},
+		Type:                IdentifyMusic,
+		StartedAt:           startedAt,
+		FingerprintMetadata: meta,
+	}
+	data, err := json.Marshal(pexFut)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	resumed, err := pexClient.ResumeSearch(data)
+	if err != nil {
+		t.Fatalf("ResumeSearch(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(resumed.LookupIDs, pexFut.LookupIDs) || resumed.Type != pexFut.Type ||
+		!resumed.StartedAt.Equal(startedAt) || !reflect.DeepEqual(resumed.FingerprintMetadata, meta) {
+		t.Errorf("ResumeSearch = %+v, want %+v", resumed, pexFut)
+	}
+
+	// The resumed future polls using the client.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := resumed.GetContext(ctx); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("GetContext: got error %v, want %v", err, ErrClientClosed)
+	}
+
+	// A Pex search can't be resumed as a private search and vice versa.
+	privateClient := &PrivateSearchClient{newClosedTestClient()}
+	var e *Error
+	if _, err := privateClient.ResumeSearch(data); !errors.As(err, &e) || e.Code != StatusInvalidInput {
+		t.Errorf("ResumeSearch of a Pex search as private: got error %v, want StatusInvalidInput", err)
+	}
+
+	privateFut := &PrivateSearchFuture{LookupIDs: []string{"c"}, StartedAt: startedAt}
+	data, err = json.Marshal(privateFut)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if _, err := pexClient.ResumeSearch(data); !errors.As(err, &e) || e.Code != StatusInvalidInput {
+		t.Errorf("ResumeSearch of a private search as Pex: got error %v, want StatusInvalidInput", err)
+	}
+	resumedPrivate, err := privateClient.ResumeSearch(data)
+	if err != nil {
+		t.Fatalf("ResumeSearch(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(resumedPrivate.LookupIDs, privateFut.LookupIDs) || !resumedPrivate.StartedAt.Equal(startedAt) ||
+		resumedPrivate.FingerprintMetadata != (FingerprintMetadata{}) {
+		t.Errorf("ResumeSearch = %+v, want %+v", resumedPrivate, privateFut)
+	}
+}
+
+func TestResumeSearchInvalid(t *testing.T) {
+	pexClient := &PexSearchClient{newClosedTestClient()}
+
+	for _, data := range []string{
+		``,
+		`{`,
+		`[]`,
+		`{"kind": "pex", "lookup_ids": "a"}`,
+		`{"kind": "pex"}`,
+		`{"kind": "pex", "lookup_ids": [""]}`,
+		`{"kind": "other", "lookup_ids": ["a"]}`,
+		`{"lookup_ids": ["a"]}`,
+	} {
+		var e *Error
+		if _, err := pexClient.ResumeSearch([]byte(data)); !errors.As(err, &e) || e.Code != StatusInvalidInput {
+			t.Errorf("ResumeSearch(%s): got error %v, want StatusInvalidInput", data, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"io"
+)
+
+// Fingerprinter generates fingerprints from media files. It's implemented by
+// both PexSearchClient and PrivateSearchClient.
+type Fingerprinter interface {
+	FingerprintFile(path string, types ...FingerprintType) (*Fingerprint, error)
+	FingerprintFileContext(ctx context.Context, path string, types ...FingerprintType) (*Fingerprint, error)
+	FingerprintBuffer(buffer []byte, types ...FingerprintType) (*Fingerprint, error)
+	FingerprintBufferContext(ctx context.Context, buffer []byte, types ...FingerprintType) (*Fingerprint, error)
+	FingerprintReader(r io.Reader, size int64, types ...FingerprintType) (*Fingerprint, error)
+	FingerprintReaderContext(ctx context.Context, r io.Reader, size int64, types ...FingerprintType) (*Fingerprint, error)
+	FingerprintFileWithOptions(ctx context.Context, path string, opts FingerprintOptions) (*Fingerprint, error)
+	FingerprintBufferWithOptions(ctx context.Context, buffer []byte, opts FingerprintOptions) (*Fingerprint, error)
+}
+
+// PexSearcher is the interface implemented by PexSearchClient. Custom
+// implementations (e.g. mocks or decorators adding retries, metrics or
+// caching) should use NewPexSearchFuture to create the futures returned by
+// StartSearch, so that the results are retrieved through them as well.
+type PexSearcher interface {
+	Fingerprinter
+
+	StartSearch(req *PexSearchRequest) (*PexSearchFuture, error)
+	StartSearchContext(ctx context.Context, req *PexSearchRequest) (*PexSearchFuture, error)
+	CheckSearch(lookupIDs []string) (*PexSearchResult, error)
+	CheckSearchContext(ctx context.Context, lookupIDs []string) (*PexSearchResult, error)
+	Close() error
+}
+
+// PrivateSearcher is the interface implemented by PrivateSearchClient.
+// Custom implementations should use NewPrivateSearchFuture to create the
+// futures returned by StartSearch.
+type PrivateSearcher interface {
+	Fingerprinter
+
+	StartSearch(req *PrivateSearchRequest) (*PrivateSearchFuture, error)
+	StartSearchContext(ctx context.Context, req *PrivateSearchRequest) (*PrivateSearchFuture, error)
+	CheckSearch(lookupIDs []string) (*PrivateSearchResult, error)
+	CheckSearchContext(ctx context.Context, lookupIDs []string) (*PrivateSearchResult, error)
+	Close() error
+}
+
+// EntryPager retrieves a single page of the entries ingested into a private
+// catalog. It's used by Lister to iterate over all the pages.
+type EntryPager interface {
+	ListEntriesPage(ctx context.Context, req *ListEntriesRequest) (*ListEntriesPage, error)
+}
+
+// Catalog manages the content of a private catalog. It's implemented by
+// PrivateSearchClient. Custom implementations should use NewLister to create
+// the listers returned by ListEntries.
+type Catalog interface {
+	EntryPager
+
+	Ingest(id string, ft *Fingerprint) error
+	IngestContext(ctx context.Context, id string, ft *Fingerprint) error
+	Archive(id string, types ...FingerprintType) error
+	ArchiveContext(ctx context.Context, id string, types ...FingerprintType) error
+	ListEntries(req *ListEntriesRequest) *Lister
+}
+
+// SearchFuture is implemented by PexSearchFuture and PrivateSearchFuture,
+// with T being *PexSearchResult and *PrivateSearchResult respectively.
+type SearchFuture[T any] interface {
+	Get() (T, error)
+	GetContext(ctx context.Context) (T, error)
+	Done() <-chan struct{}
+	Wait(ctx context.Context) error
+	TryGet() (T, bool, error)
+	Cancel()
+}
+
+var (
+	_ PexSearcher                        = (*PexSearchClient)(nil)
+	_ PrivateSearcher                    = (*PrivateSearchClient)(nil)
+	_ Catalog                            = (*PrivateSearchClient)(nil)
+	_ SearchFuture[*PexSearchResult]     = (*PexSearchFuture)(nil)
+	_ SearchFuture[*PrivateSearchResult] = (*PrivateSearchFuture)(nil)
+)
@@ -0,0 +1,455 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults used by LongFormSearcher.
+const (
+	DefaultLongFormWindow      = 10 * time.Minute
+	DefaultLongFormOverlap     = 30 * time.Second
+	DefaultLongFormConcurrency = 4
+)
+
+// LongFormOptions configure a LongFormSearcher.
+type LongFormOptions struct {
+	// Window is the duration of the windows the media is split into. It
+	// defaults to DefaultLongFormWindow.
+	Window time.Duration
+
+	// Overlap is the duration by which the consecutive windows overlap, so
+	// that matches spanning the boundary of two windows aren't missed. It
+	// defaults to DefaultLongFormOverlap and must be shorter than Window.
+	Overlap time.Duration
+
+	// Concurrency is the maximum number of windows fingerprinted and
+	// searched concurrently. It defaults to DefaultLongFormConcurrency.
+	Concurrency int
+
+	// Types specifies which types of fingerprints to create. If empty,
+	// FingerprintTypeAll is assumed.
+	Types []FingerprintType
+
+	// Fingerprinter, if set, is used to fingerprint the windows instead of
+	// the client performing the search, e.g. a FingerprintWorkerPool.
+	Fingerprinter Fingerprinter
+}
+
+// LongFormSearcher searches long recordings, e.g. broadcasts or podcasts,
+// that are impractical to fingerprint and search as a whole. The media is
+// split into overlapping windows, which are fingerprinted (see
+// FingerprintOptions, the windows are extracted using ffmpeg) and searched
+// independently, and the results are stitched together: the query segments
+// are shifted to the positions in the whole media, and the matches of the
+// same asset found in multiple windows are merged into one.
+type LongFormSearcher struct {
+	opts LongFormOptions
+}
+
+// NewLongFormSearcher creates a searcher with the given options.
+func NewLongFormSearcher(opts LongFormOptions) (*LongFormSearcher, error) {
+	if opts.Window == 0 {
+		opts.Window = DefaultLongFormWindow
+	}
+	if opts.Overlap == 0 {
+		opts.Overlap = DefaultLongFormOverlap
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultLongFormConcurrency
+	}
+
+	if opts.Window < time.Second {
+		return nil, errInvalidInput("window must be at least 1 second, got %v", opts.Window)
+	}
+	if opts.Overlap < 0 || opts.Overlap >= opts.Window {
+		return nil, errInvalidInput("overlap (%v) must be between zero and window (%v)", opts.Overlap, opts.Window)
+	}
+	if err := validateTypes(opts.Types); err != nil {
+		return nil, err
+	}
+	return &LongFormSearcher{opts: opts}, nil
+}
+
+// PexSearch performs a Pex search of the media file using the given client.
+// The duration of the media is determined using ProbeMediaFile. The search
+// fails as soon as any of the windows fails.
+func (x *LongFormSearcher) PexSearch(ctx context.Context, client PexSearcher, path string, typ PexSearchType) (*PexSearchResult, error) {
+	duration, results, err := searchWindows(ctx, x, client, path, func(ctx context.Context, ft *Fingerprint) (*PexSearchResult, error) {
+		fut, err := client.StartSearchContext(ctx, &PexSearchRequest{
+			Fingerprint: ft,
+			Type:        typ,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		defer fut.Cancel()
+		res, err := fut.GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res.ShiftQuery(ft.Offset())
+		res.ContentClassification.shift(ft.Offset())
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergePexResults(results, duration), nil
+}
+
+// PrivateSearch is like PexSearch, but performs a private search.
+func (x *LongFormSearcher) PrivateSearch(ctx context.Context, client PrivateSearcher, path string) (*PrivateSearchResult, error) {
+	duration, results, err := searchWindows(ctx, x, client, path, func(ctx context.Context, ft *Fingerprint) (*PrivateSearchResult, error) {
+		fut, err := client.StartSearchContext(ctx, &PrivateSearchRequest{
+			Fingerprint: ft,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		defer fut.Cancel()
+		res, err := fut.GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res.ShiftQuery(ft.Offset())
+		res.ContentClassification.shift(ft.Offset())
+		return res, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergePrivateResults(results, duration), nil
+}
+
+type longFormWindow struct {
+	start, end time.Duration
+}
+
+// windows splits media of the given duration. The end of the last window is
+// left open, so that the end of the media isn't missed if the duration is
+// imprecise.
+func (x *LongFormSearcher) windows(duration time.Duration) []longFormWindow {
+	var out []longFormWindow
+	for start := time.Duration(0); ; start += x.opts.Window - x.opts.Overlap {
+		end := start + x.opts.Window
+		if end >= duration {
+			out = append(out, longFormWindow{start: start})
+			return out
+		}
+		out = append(out, longFormWindow{start: start, end: end})
+	}
+}
+
+// searchWindows fingerprints and searches all the windows of the file and
+// returns the duration of the file along with the results ordered by the
+// windows.
+func searchWindows[T any](parent context.Context, x *LongFormSearcher, fp Fingerprinter, path string, search func(context.Context, *Fingerprint) (T, error)) (time.Duration, []T, error) {
+	if err := validatePath(path); err != nil {
+		return 0, nil, err
+	}
+	if x.opts.Fingerprinter != nil {
+		fp = x.opts.Fingerprinter
+	}
+
+	info, err := ProbeMediaFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if info.Duration == 0 {
+		return 0, nil, errInvalidInput("can't determine the duration of the media: %s", info.Reason)
+	}
+
+	windows := x.windows(info.Duration)
+	results := make([]T, len(windows))
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		sem      = make(chan struct{}, x.opts.Concurrency)
+	)
+	for i, w := range windows {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, w longFormWindow) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ft, err := fp.FingerprintFileWithOptions(ctx, path, FingerprintOptions{
+				Types: x.opts.Types,
+				Start: w.start,
+				End:   w.end,
+			})
+			if err == nil {
+				results[i], err = search(ctx, ft)
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, w)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, nil, firstErr
+	}
+	if err := parent.Err(); err != nil {
+		return 0, nil, err
+	}
+	return info.Duration, results, nil
+}
+
+func mergePexResults(results []*PexSearchResult, duration time.Duration) *PexSearchResult {
+	out := &PexSearchResult{
+		QueryFileDurationSeconds: float32(duration.Seconds()),
+	}
+
+	index := make(map[string]int)
+	var details [][]MatchDetails
+	var classifications []ContentClassification
+
+	for _, res := range results {
+		out.LookupIDs = append(out.LookupIDs, res.LookupIDs...)
+		classifications = append(classifications, res.ContentClassification)
+
+		for _, m := range res.Matches {
+			// Matches without an asset can't be told apart, so they're
+			// kept as they are.
+			if m.Asset == nil {
+				out.Matches = append(out.Matches, &PexSearchMatch{})
+				details = append(details, []MatchDetails{m.MatchDetails})
+				continue
+			}
+
+			key := m.Asset.ID
+			i, ok := index[key]
+			if !ok {
+				i = len(out.Matches)
+				index[key] = i
+				out.Matches = append(out.Matches, &PexSearchMatch{Asset: m.Asset})
+				details = append(details, nil)
+			}
+			details[i] = append(details[i], m.MatchDetails)
+		}
+	}
+
+	for i, m := range out.Matches {
+		m.MatchDetails = mergeMatchDetails(details[i], duration)
+	}
+	out.ContentClassification = mergeContentClassifications(classifications)
+	return out
+}
+
+func mergePrivateResults(results []*PrivateSearchResult, duration time.Duration) *PrivateSearchResult {
+	out := &PrivateSearchResult{
+		QueryFileDurationSeconds: float32(duration.Seconds()),
+	}
+
+	type matchKey struct{ catalog, id string }
+	index := make(map[matchKey]int)
+	var details [][]MatchDetails
+	var classifications []ContentClassification
+
+	for _, res := range results {
+		out.LookupIDs = append(out.LookupIDs, res.LookupIDs...)
+		classifications = append(classifications, res.ContentClassification)
+
+		for _, m := range res.Matches {
+			key := matchKey{m.Catalog, m.ProvidedID}
+			i, ok := index[key]
+			if !ok {
+				i = len(out.Matches)
+				index[key] = i
+				out.Matches = append(out.Matches, &PrivateSearchMatch{
+					ProvidedID: m.ProvidedID,
+					Catalog:    m.Catalog,
+				})
+				details = append(details, nil)
+			}
+			if m.MatchDetails != nil {
+				details[i] = append(details[i], *m.MatchDetails)
+			}
+		}
+	}
+
+	for i, m := range out.Matches {
+		d := mergeMatchDetails(details[i], duration)
+		m.MatchDetails = &d
+	}
+	out.ContentClassification = mergeContentClassifications(classifications)
+	return out
+}
+
+func (x *MatchDetails) segmentDetails() []**SegmentDetails {
+	return []**SegmentDetails{&x.Audio, &x.Melody, &x.Video, &x.Phonetic}
+}
+
+// mergeMatchDetails merges the details of the matches of one asset found in
+// multiple windows. The match durations and percentages are recomputed from
+// the merged segments.
+func mergeMatchDetails(all []MatchDetails, duration time.Duration) MatchDetails {
+	var out MatchDetails
+	for k, dst := range out.segmentDetails() {
+		var segments []Segment
+		var assetDuration float64
+		found := false
+
+		for i := range all {
+			d := *all[i].segmentDetails()[k]
+			if d == nil {
+				continue
+			}
+			found = true
+			segments = append(segments, d.Segments...)
+
+			// The duration of the asset isn't part of the result, but it can
+			// be derived from any window.
+			if assetDuration == 0 && d.AssetMatchPercentage > 0 {
+				assetDuration = float64(d.AssetMatchDurationSeconds) * 100 / float64(d.AssetMatchPercentage)
+			}
+		}
+		if !found {
+			continue
+		}
+
+		d := &SegmentDetails{
+			Segments: mergeSegments(segments),
+		}
+		for _, s := range d.Segments {
+			d.QueryMatchDurationSeconds += float32(s.QueryEnd - s.QueryStart)
+			d.AssetMatchDurationSeconds += float32(s.AssetEnd - s.AssetStart)
+		}
+		if secs := duration.Seconds(); secs > 0 {
+			d.QueryMatchPercentage = percentage(float64(d.QueryMatchDurationSeconds), secs)
+		}
+		if assetDuration > 0 {
+			d.AssetMatchPercentage = percentage(float64(d.AssetMatchDurationSeconds), assetDuration)
+		}
+		*dst = d
+	}
+	return out
+}
+
+func percentage(part, whole float64) float32 {
+	p := part * 100 / whole
+	if p > 100 {
+		p = 100
+	}
+	return float32(p)
+}
+
+// mergeSegments merges the segments found in overlapping windows. Two
+// segments are merged if they overlap (or touch) in the query and align the
+// query with the asset the same way, give or take a second.
+func mergeSegments(segments []Segment) []Segment {
+	if len(segments) == 0 {
+		return segments
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		di, dj := segments[i].AssetStart-segments[i].QueryStart, segments[j].AssetStart-segments[j].QueryStart
+		if di != dj {
+			return di < dj
+		}
+		return segments[i].QueryStart < segments[j].QueryStart
+	})
+
+	out := []Segment{segments[0]}
+	for _, s := range segments[1:] {
+		cur := &out[len(out)-1]
+
+		delta := (s.AssetStart - s.QueryStart) - (cur.AssetStart - cur.QueryStart)
+		if delta > 1 || s.QueryStart > cur.QueryEnd {
+			out = append(out, s)
+			continue
+		}
+
+		if s.QueryEnd > cur.QueryEnd {
+			cur.QueryEnd = s.QueryEnd
+		}
+		if s.AssetEnd > cur.AssetEnd {
+			cur.AssetEnd = s.AssetEnd
+		}
+		if s.Confidence > cur.Confidence {
+			cur.Confidence = s.Confidence
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].QueryStart < out[j].QueryStart
+	})
+	return out
+}
+
+// shift moves the segments by the given offset, rounded to the nearest
+// second like the offsets of the match segments, see Segment.ShiftQuery.
+func (x *ContentClassification) shift(offset time.Duration) {
+	secs := offsetSeconds(offset)
+	for _, segments := range [][]ContentClassificationSegment{x.Music, x.Speech, x.Silence} {
+		for i := range segments {
+			segments[i].Start += secs
+			segments[i].End += secs
+		}
+	}
+}
+
+func mergeContentClassifications(all []ContentClassification) ContentClassification {
+	var out ContentClassification
+	for _, c := range all {
+		out.Music = append(out.Music, c.Music...)
+		out.Speech = append(out.Speech, c.Speech...)
+		out.Silence = append(out.Silence, c.Silence...)
+	}
+	out.Music = mergeClassificationSegments(out.Music)
+	out.Speech = mergeClassificationSegments(out.Speech)
+	out.Silence = mergeClassificationSegments(out.Silence)
+	return out
+}
+
+// mergeClassificationSegments merges the overlapping segments of the same
+// class. The subclasses of the first segment are kept.
+func mergeClassificationSegments(segments []ContentClassificationSegment) []ContentClassificationSegment {
+	if len(segments) == 0 {
+		return segments
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].Start < segments[j].Start
+	})
+
+	out := []ContentClassificationSegment{segments[0]}
+	for _, s := range segments[1:] {
+		cur := &out[len(out)-1]
+		if s.Start > cur.End {
+			out = append(out, s)
+			continue
+		}
+		if s.End > cur.End {
+			cur.End = s.End
+		}
+		if s.Confidence > cur.Confidence {
+			cur.Confidence = s.Confidence
+		}
+	}
+	return out
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLongFormWindows(t *testing.T) {
+	x, err := NewLongFormSearcher(LongFormOptions{Window: 10 * time.Second, Overlap: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("NewLongFormSearcher: %v", err)
+	}
+
+	got := x.windows(25 * time.Second)
+	want := []longFormWindow{
+		{0, 10 * time.Second},
+		{8 * time.Second, 18 * time.Second},
+		{16 * time.Second, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("windows(25s) = %v, want %v", got, want)
+	}
+}
+
+func audioMatch(asset *PexSearchAsset, segments ...Segment) *PexSearchMatch {
+	return &PexSearchMatch{
+		Asset:        asset,
+		MatchDetails: MatchDetails{Audio: &SegmentDetails{Segments: segments}},
+	}
+}
+
+func TestMergePexResults(t *testing.T) {
+	asset := &PexSearchAsset{ID: "a"}
+
+	// The windows start at 0s and 8s, the second window's segments are
+	// already shifted.
+	results := []*PexSearchResult{
+		{Matches: []*PexSearchMatch{
+			audioMatch(asset, Segment{QueryStart: 5, QueryEnd: 10, AssetStart: 105, AssetEnd: 110}),
+			audioMatch(nil, Segment{QueryStart: 0, QueryEnd: 2, AssetStart: 0, AssetEnd: 2}),
+		}},
+		{Matches: []*PexSearchMatch{
+			audioMatch(asset, Segment{QueryStart: 8, QueryEnd: 14, AssetStart: 108, AssetEnd: 114}),
+			audioMatch(nil, Segment{QueryStart: 9, QueryEnd: 12, AssetStart: 50, AssetEnd: 53}),
+		}},
+	}
+
+	res := mergePexResults(results, 20*time.Second)
+	if len(res.Matches) != 3 {
+		t.Fatalf("got %d matches, want 3", len(res.Matches))
+	}
+
+	m := res.Matches[0]
+	if m.Asset != asset {
+		t.Errorf("match 0: got asset %v, want %v", m.Asset, asset)
+	}
+	wantSegments := []Segment{{QueryStart: 5, QueryEnd: 14, AssetStart: 105, AssetEnd: 114}}
+	if got := m.MatchDetails.Audio.Segments; !reflect.DeepEqual(got, wantSegments) {
+		t.Errorf("match 0: got segments %v, want %v", got, wantSegments)
+	}
+	if got := m.MatchDetails.Audio.QueryMatchPercentage; got != 45 {
+		t.Errorf("match 0: got query match percentage %v, want 45", got)
+	}
+
+	// The matches without an asset aren't merged.
+	for i, want := range []int64{0, 9} {
+		m := res.Matches[1+i]
+		if m.Asset != nil || len(m.MatchDetails.Audio.Segments) != 1 || m.MatchDetails.Audio.Segments[0].QueryStart != want {
+			t.Errorf("match %d: got %+v, want the unmerged match starting at %ds", 1+i, m.MatchDetails.Audio, want)
+		}
+	}
+}
+
+func TestContentClassificationShift(t *testing.T) {
+	tests := []struct {
+		offset time.Duration
+		want   int64
+	}{
+		{0, 10},
+		{time.Second, 11},
+		{1400 * time.Millisecond, 11},
+		{1900 * time.Millisecond, 12},
+	}
+	for _, tt := range tests {
+		c := ContentClassification{Music: []ContentClassificationSegment{{Start: 10, End: 20}}}
+		c.shift(tt.offset)
+		if got := c.Music[0]; got.Start != tt.want || got.End != tt.want+10 {
+			t.Errorf("shift(%v): got [%d, %d), want [%d, %d)", tt.offset, got.Start, got.End, tt.want, tt.want+10)
+		}
+	}
+}
@@ -0,0 +1,1263 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// MediaInfo describes media inspected by ProbeMedia.
+type MediaInfo struct {
+	// Container is the name of the container format: "mp4", "mov",
+	// "matroska", "webm", "mpegts", "adts", "mp3" or "wav". It's empty if
+	// the format wasn't recognized.
+	Container string
+
+	// AudioCodecs and VideoCodecs list the codecs of the streams found in
+	// the container, e.g. "aac" or "h264".
+	AudioCodecs []string
+	VideoCodecs []string
+
+	// Duration is the duration of the media as declared by the container,
+	// or estimated from the stream for the formats that don't declare it. It's
+	// zero if it's not known.
+	Duration time.Duration
+
+	// Fingerprintable reports whether the media is supported by the native
+	// library: it must contain an aac audio stream or an h264 or h265 video
+	// stream, and must be longer than 1 second. If it's not, Reason explains
+	// why.
+	Fingerprintable bool
+	Reason          string
+}
+
+var (
+	supportedAudioCodecs = []string{"aac"}
+	supportedVideoCodecs = []string{"h264", "h265"}
+)
+
+// WithMediaPreflight makes the client inspect the media using ProbeMedia
+// before fingerprinting it, and reject the media that's not fingerprintable
+// with StatusInvalidInput without calling the native library. Keep in mind
+// that ProbeMedia only recognizes the most common container formats, so
+// the check is stricter than the native library.
+func WithMediaPreflight() Option {
+	return func(o *options) {
+		o.preflight = true
+	}
+}
+
+// ProbeMediaFile is like ProbeMedia, but inspects a file.
+func ProbeMediaFile(path string) (*MediaInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ProbeMedia(f, info.Size())
+}
+
+// ProbeMediaBuffer is like ProbeMedia, but inspects media loaded in memory.
+func ProbeMediaBuffer(buffer []byte) (*MediaInfo, error) {
+	return ProbeMedia(bytes.NewReader(buffer), int64(len(buffer)))
+}
+
+// ProbeMedia inspects the container headers of media of the given size
+// without decoding it, which is much cheaper than fingerprinting it. The
+// supported containers are MP4/MOV, Matroska/WebM, MPEG-TS, ADTS, MP3 and
+// WAV. Media that's not recognized or is malformed is reported as not
+// fingerprintable; an error is only returned if reading the media fails.
+func ProbeMedia(r io.ReaderAt, size int64) (*MediaInfo, error) {
+	info := new(MediaInfo)
+
+	err := probe(r, size, info)
+
+	var me malformedError
+	switch {
+	case errors.As(err, &me):
+		name := info.Container
+		if name == "" {
+			name = "media"
+		}
+		info.Reason = fmt.Sprintf("malformed %s: %s", name, string(me))
+		return info, nil
+	case err != nil:
+		return nil, err
+	}
+
+	switch {
+	case info.Container == "":
+		info.Reason = "unrecognized media format"
+	case !containsAny(info.AudioCodecs, supportedAudioCodecs) && !containsAny(info.VideoCodecs, supportedVideoCodecs):
+		info.Reason = fmt.Sprintf("no supported stream found (audio: %s, video: %s)",
+			strings.Join(supportedAudioCodecs, ", "), strings.Join(supportedVideoCodecs, ", "))
+	case info.Duration > 0 && info.Duration <= time.Second:
+		info.Reason = "media must be longer than 1 second"
+	default:
+		info.Fingerprintable = true
+	}
+	return info, nil
+}
+
+// checkMedia implements WithMediaPreflight.
+func (x *options) checkMedia(input []byte, isFile bool) error {
+	if !x.preflight {
+		return nil
+	}
+
+	var info *MediaInfo
+	var err error
+	if isFile {
+		info, err = ProbeMediaFile(string(input))
+	} else {
+		info, err = ProbeMediaBuffer(input)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Fingerprintable {
+		return errInvalidInput("unsupported media: %s", info.Reason)
+	}
+	return nil
+}
+
+func containsAny(list, values []string) bool {
+	for _, a := range list {
+		for _, b := range values {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// malformedError is returned by the parsers when the media is recognized but
+// its structure is invalid or truncated.
+type malformedError string
+
+func (x malformedError) Error() string {
+	return string(x)
+}
+
+func malformed(format string, args ...any) error {
+	return malformedError(fmt.Sprintf(format, args...))
+}
+
+// readAt reads exactly n bytes at the offset. Reading past the end of the
+// media is reported as malformed media.
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, off); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, malformed("unexpected end of data")
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func probe(r io.ReaderAt, size int64, info *MediaInfo) error {
+	head := make([]byte, 16)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	head = head[:n]
+
+	switch {
+	case len(head) >= 12 && isMP4Box(string(head[4:8])):
+		return probeMP4(r, size, info)
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		info.Container = "wav"
+		return probeWAV(r, size, info)
+	case len(head) >= 4 && binary.BigEndian.Uint32(head) == ebmlHeaderID:
+		info.Container = "matroska"
+		return probeMatroska(r, size, info)
+	case isMPEGTS(r, size):
+		info.Container = "mpegts"
+		return probeMPEGTS(r, size, info)
+	}
+
+	off, err := skipID3(r, size)
+	if err != nil {
+		return err
+	}
+	h, err := readAt(r, off, 4)
+	if err != nil {
+		return nil // too short to tell
+	}
+	switch {
+	case h[0] == 0xff && h[1]&0xf6 == 0xf0:
+		info.Container = "adts"
+		return probeADTS(r, off, size, info)
+	case isMP3Header(h):
+		info.Container = "mp3"
+		return probeMP3(r, off, size, info)
+	}
+	return nil
+}
+
+// MP4/MOV
+
+func isMP4Box(typ string) bool {
+	switch typ {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "pnot":
+		return true
+	}
+	return false
+}
+
+type mp4Box struct {
+	typ       string
+	off, size int64
+	hdr       int64
+}
+
+func (x mp4Box) data() int64 { return x.off + x.hdr }
+func (x mp4Box) end() int64  { return x.off + x.size }
+
+// readMP4Box reads the header of the box at the offset. The size of the
+// last box may be zero, meaning it extends to the end.
+func readMP4Box(r io.ReaderAt, off, end int64) (mp4Box, error) {
+	h, err := readAt(r, off, 8)
+	if err != nil {
+		return mp4Box{}, err
+	}
+
+	b := mp4Box{
+		typ:  string(h[4:8]),
+		off:  off,
+		size: int64(binary.BigEndian.Uint32(h)),
+		hdr:  8,
+	}
+	switch b.size {
+	case 0:
+		b.size = end - off
+	case 1:
+		ext, err := readAt(r, off+8, 8)
+		if err != nil {
+			return mp4Box{}, err
+		}
+		b.size = int64(binary.BigEndian.Uint64(ext))
+		b.hdr = 16
+	}
+	if b.size < b.hdr || b.size > math.MaxInt64-off {
+		return mp4Box{}, malformed("invalid size of box %q", b.typ)
+	}
+	return b, nil
+}
+
+// walkMP4 calls fn for all the boxes between the offsets.
+func walkMP4(r io.ReaderAt, start, end int64, fn func(mp4Box) error) error {
+	for off := start; off+8 <= end; {
+		b, err := readMP4Box(r, off, end)
+		if err != nil {
+			return err
+		}
+		if b.end() > end {
+			return malformed("box %q exceeds its parent", b.typ)
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+		off = b.end()
+	}
+	return nil
+}
+
+func probeMP4(r io.ReaderAt, size int64, info *MediaInfo) error {
+	info.Container = "mov"
+
+	var moov *mp4Box
+	for off := int64(0); off+8 <= size && moov == nil; {
+		b, err := readMP4Box(r, off, size)
+		if err != nil {
+			return err
+		}
+		switch b.typ {
+		case "ftyp":
+			brand, err := readAt(r, b.data(), 4)
+			if err != nil {
+				return err
+			}
+			if string(brand) != "qt  " {
+				info.Container = "mp4"
+			}
+		case "moov":
+			moov = &b
+		}
+		off = b.end()
+	}
+	if moov == nil {
+		return malformed("moov box not found")
+	}
+	if moov.end() > size {
+		return malformed("moov box is truncated")
+	}
+
+	return walkMP4(r, moov.data(), moov.end(), func(b mp4Box) error {
+		switch b.typ {
+		case "mvhd":
+			return probeMVHD(r, b, info)
+		case "trak":
+			return probeTrak(r, b, info)
+		}
+		return nil
+	})
+}
+
+func probeMVHD(r io.ReaderAt, b mp4Box, info *MediaInfo) error {
+	h, err := readAt(r, b.data(), 1)
+	if err != nil {
+		return err
+	}
+
+	var scale, duration uint64
+	if h[0] == 1 {
+		d, err := readAt(r, b.data()+20, 12)
+		if err != nil {
+			return err
+		}
+		scale = uint64(binary.BigEndian.Uint32(d))
+		duration = binary.BigEndian.Uint64(d[4:])
+		if duration == math.MaxUint64 {
+			duration = 0
+		}
+	} else {
+		d, err := readAt(r, b.data()+12, 8)
+		if err != nil {
+			return err
+		}
+		scale = uint64(binary.BigEndian.Uint32(d))
+		duration = uint64(binary.BigEndian.Uint32(d[4:]))
+		if duration == math.MaxUint32 {
+			duration = 0
+		}
+	}
+
+	if scale > 0 {
+		info.Duration = scaleDuration(duration, scale)
+	}
+	return nil
+}
+
+// scaleDuration converts a duration in units of 1/scale seconds.
+func scaleDuration(d, scale uint64) time.Duration {
+	secs := float64(d) / float64(scale)
+	if secs >= math.MaxInt64/float64(time.Second) {
+		return 0
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+func probeTrak(r io.ReaderAt, trak mp4Box, info *MediaInfo) error {
+	var handler, codec string
+
+	var walk func(b mp4Box) error
+	walk = func(b mp4Box) error {
+		switch b.typ {
+		case "mdia", "minf", "stbl":
+			return walkMP4(r, b.data(), b.end(), walk)
+		case "hdlr":
+			h, err := readAt(r, b.data()+8, 4)
+			if err != nil {
+				return err
+			}
+			handler = string(h)
+		case "stsd":
+			// Only the first sample entry is considered, it's rare for a
+			// track to have more.
+			entry, err := readMP4Box(r, b.data()+8, b.end())
+			if err != nil {
+				return err
+			}
+			if entry.end() > b.end() {
+				return malformed("sample entry exceeds its parent")
+			}
+			if codec, err = mp4Codec(r, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walkMP4(r, trak.data(), trak.end(), walk); err != nil {
+		return err
+	}
+
+	switch handler {
+	case "soun":
+		info.AudioCodecs = append(info.AudioCodecs, codec)
+	case "vide":
+		info.VideoCodecs = append(info.VideoCodecs, codec)
+	}
+	return nil
+}
+
+func mp4Codec(r io.ReaderAt, entry mp4Box) (string, error) {
+	switch entry.typ {
+	case "avc1", "avc3":
+		return "h264", nil
+	case "hvc1", "hev1":
+		return "h265", nil
+	case "vp08":
+		return "vp8", nil
+	case "vp09":
+		return "vp9", nil
+	case "av01":
+		return "av1", nil
+	case "mp4v":
+		return "mpeg4", nil
+	case "Opus":
+		return "opus", nil
+	case "ac-3":
+		return "ac3", nil
+	case "ec-3":
+		return "eac3", nil
+	case "fLaC":
+		return "flac", nil
+	case ".mp3":
+		return "mp3", nil
+	case "lpcm", "sowt", "twos", "raw ", "in24", "in32", "fl32", "fl64":
+		return "pcm", nil
+	case "mp4a":
+		return mp4aCodec(r, entry)
+	}
+	return strings.TrimSpace(strings.ToLower(entry.typ)), nil
+}
+
+// mp4aCodec determines the codec of an MPEG-4 audio sample entry, which is
+// usually aac, from the object type in its elementary stream descriptor.
+func mp4aCodec(r io.ReaderAt, entry mp4Box) (string, error) {
+	// The children of an audio sample entry follow 28 bytes of fields, plus
+	// 16 or 36 bytes in the QuickTime sound description version 1 or 2.
+	v, err := readAt(r, entry.data()+8, 2)
+	if err != nil {
+		return "", err
+	}
+	start := entry.data() + 28
+	switch binary.BigEndian.Uint16(v) {
+	case 1:
+		start += 16
+	case 2:
+		start += 36
+	}
+
+	var esds *mp4Box
+	var walk func(b mp4Box) error
+	walk = func(b mp4Box) error {
+		switch b.typ {
+		case "wave":
+			return walkMP4(r, b.data(), b.end(), walk)
+		case "esds":
+			esds = &b
+		}
+		return nil
+	}
+	if err := walkMP4(r, start, entry.end(), walk); err != nil {
+		return "", err
+	}
+	if esds == nil || esds.size > 1<<16 {
+		return "aac", nil
+	}
+
+	d, err := readAt(r, esds.data(), int(esds.size-esds.hdr))
+	if err != nil {
+		return "", err
+	}
+	switch esdsObjectType(d) {
+	case 0x69, 0x6b:
+		return "mp3", nil
+	case 0xa5:
+		return "ac3", nil
+	case 0xa6:
+		return "eac3", nil
+	}
+	return "aac", nil
+}
+
+// esdsObjectType returns the object type indication from the contents of an
+// esds box, or zero if it can't be found.
+func esdsObjectType(d []byte) byte {
+	if len(d) < 4 {
+		return 0
+	}
+	d = d[4:] // version and flags
+
+	next := func(want byte) []byte {
+		if len(d) < 2 || d[0] != want {
+			return nil
+		}
+		i, n := 1, 0
+		for ; i < len(d) && i <= 4; i++ {
+			n = n<<7 | int(d[i]&0x7f)
+			if d[i]&0x80 == 0 {
+				i++
+				break
+			}
+		}
+		if i+n > len(d) {
+			return nil
+		}
+		return d[i : i+n]
+	}
+
+	es := next(0x03)
+	if len(es) < 3 {
+		return 0
+	}
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 {
+		es = es[minInt(2, len(es)):]
+	}
+	if flags&0x40 != 0 && len(es) > 0 {
+		es = es[minInt(1+int(es[0]), len(es)):]
+	}
+	if flags&0x20 != 0 {
+		es = es[minInt(2, len(es)):]
+	}
+
+	d = es
+	if dc := next(0x04); len(dc) > 0 {
+		return dc[0]
+	}
+	return 0
+}
+
+// WAV
+
+func probeWAV(r io.ReaderAt, size int64, info *MediaInfo) error {
+	var byteRate uint32
+	for off := int64(12); off+8 <= size; {
+		h, err := readAt(r, off, 8)
+		if err != nil {
+			return err
+		}
+		id := string(h[:4])
+		n := int64(binary.LittleEndian.Uint32(h[4:]))
+
+		switch id {
+		case "fmt ":
+			f, err := readAt(r, off+8, 16)
+			if err != nil {
+				return err
+			}
+			info.AudioCodecs = append(info.AudioCodecs, wavCodec(binary.LittleEndian.Uint16(f)))
+			byteRate = binary.LittleEndian.Uint32(f[8:])
+		case "data":
+			// The size might be unset when the file was streamed.
+			if n == math.MaxUint32 || off+8+n > size {
+				n = size - off - 8
+			}
+			if byteRate > 0 {
+				info.Duration = scaleDuration(uint64(n), uint64(byteRate))
+			}
+			return nil
+		}
+		off += 8 + n + n&1
+	}
+
+	if len(info.AudioCodecs) == 0 {
+		return malformed("fmt chunk not found")
+	}
+	return nil
+}
+
+func wavCodec(format uint16) string {
+	switch format {
+	case 0x0001, 0xfffe:
+		return "pcm"
+	case 0x0003:
+		return "pcm_float"
+	case 0x0006:
+		return "alaw"
+	case 0x0007:
+		return "mulaw"
+	case 0x0055:
+		return "mp3"
+	case 0x00ff, 0x1610:
+		return "aac"
+	}
+	return fmt.Sprintf("wav_0x%04x", format)
+}
+
+// ADTS and MP3
+
+// skipID3 returns the offset following the ID3v2 tag at the beginning of the
+// media, if there's any.
+func skipID3(r io.ReaderAt, size int64) (int64, error) {
+	h, err := readAt(r, 0, 10)
+	if err != nil || string(h[:3]) != "ID3" {
+		return 0, nil
+	}
+	n := int64(h[6]&0x7f)<<21 | int64(h[7]&0x7f)<<14 | int64(h[8]&0x7f)<<7 | int64(h[9]&0x7f)
+	off := 10 + n
+	if h[5]&0x10 != 0 {
+		off += 10 // footer
+	}
+	if off > size {
+		return 0, malformed("truncated ID3 tag")
+	}
+	return off, nil
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func probeADTS(r io.ReaderAt, off, size int64, info *MediaInfo) error {
+	info.AudioCodecs = append(info.AudioCodecs, "aac")
+
+	br := bufio.NewReader(io.NewSectionReader(r, off, size-off))
+	h := make([]byte, 7)
+
+	var samples uint64
+	var rate int
+	for frames := 0; ; frames++ {
+		if _, err := io.ReadFull(br, h); err != nil || h[0] != 0xff || h[1]&0xf6 != 0xf0 {
+			// The stream ends at the end of the data, or at the first
+			// thing that's not a frame, e.g. an ID3v1 tag.
+			if frames == 0 {
+				return malformed("no ADTS frame found")
+			}
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return err
+			}
+			break
+		}
+
+		idx := int(h[2]>>2) & 0x0f
+		if idx >= len(adtsSampleRates) {
+			return malformed("invalid sampling frequency index %d", idx)
+		}
+		rate = adtsSampleRates[idx]
+
+		n := int(h[3]&0x03)<<11 | int(h[4])<<3 | int(h[5]>>5)
+		if n < len(h) {
+			return malformed("invalid frame length %d", n)
+		}
+		samples += uint64(1024 * (int(h[6]&0x03) + 1))
+
+		if _, err := br.Discard(n - len(h)); err != nil {
+			break // truncated last frame
+		}
+	}
+
+	info.Duration = scaleDuration(samples, uint64(rate))
+	return nil
+}
+
+var (
+	mp3Bitrates = [5][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // MPEG-1 layer I
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // MPEG-1 layer II
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // MPEG-1 layer III
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},    // MPEG-2 layer I
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},         // MPEG-2 layers II and III
+	}
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},  // MPEG-2.5
+		{},                    // reserved
+		{22050, 24000, 16000}, // MPEG-2
+		{44100, 48000, 32000}, // MPEG-1
+	}
+)
+
+type mp3Header struct {
+	version    int // index into mp3SampleRates
+	layer      int // 1, 2 or 3
+	bitrate    int // in bits per second
+	sampleRate int
+	mono       bool
+}
+
+func isMP3Header(h []byte) bool {
+	_, ok := parseMP3Header(h)
+	return ok
+}
+
+func parseMP3Header(h []byte) (mp3Header, bool) {
+	if len(h) < 4 || h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return mp3Header{}, false
+	}
+
+	x := mp3Header{
+		version: int(h[1]>>3) & 0x03,
+		layer:   4 - int(h[1]>>1)&0x03,
+		mono:    h[3]>>6 == 3,
+	}
+	bitrateIdx := int(h[2] >> 4)
+	rateIdx := int(h[2]>>2) & 0x03
+	if x.version == 1 || x.layer == 4 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+		return mp3Header{}, false
+	}
+
+	table := x.layer - 1
+	if x.version != 3 {
+		table = 4
+		if x.layer == 1 {
+			table = 3
+		}
+	}
+	x.bitrate = mp3Bitrates[table][bitrateIdx] * 1000
+	x.sampleRate = mp3SampleRates[x.version][rateIdx]
+	return x, true
+}
+
+func (x mp3Header) samplesPerFrame() int {
+	switch {
+	case x.layer == 1:
+		return 384
+	case x.layer == 3 && x.version != 3:
+		return 576
+	}
+	return 1152
+}
+
+func probeMP3(r io.ReaderAt, off, size int64, info *MediaInfo) error {
+	h, err := readAt(r, off, 4)
+	if err != nil {
+		return err
+	}
+	hdr, _ := parseMP3Header(h)
+	info.AudioCodecs = append(info.AudioCodecs, fmt.Sprintf("mp%d", hdr.layer))
+
+	// VBR files declare the number of frames in a Xing (or Info) header,
+	// which follows the side information of the first frame, or in a VBRI
+	// header at a fixed position.
+	side := 32
+	switch {
+	case hdr.version == 3 && hdr.mono, hdr.version != 3 && !hdr.mono:
+		side = 17
+	case hdr.version != 3 && hdr.mono:
+		side = 9
+	}
+
+	frames := uint64(0)
+	if x, err := readAt(r, off+4+int64(side), 12); err == nil && (string(x[:4]) == "Xing" || string(x[:4]) == "Info") {
+		if binary.BigEndian.Uint32(x[4:])&1 != 0 {
+			frames = uint64(binary.BigEndian.Uint32(x[8:]))
+		}
+	} else if v, err := readAt(r, off+36, 18); err == nil && string(v[:4]) == "VBRI" {
+		frames = uint64(binary.BigEndian.Uint32(v[14:]))
+	}
+
+	if frames > 0 {
+		info.Duration = scaleDuration(frames*uint64(hdr.samplesPerFrame()), uint64(hdr.sampleRate))
+	} else {
+		// Assume constant bitrate.
+		info.Duration = scaleDuration(uint64(size-off)*8, uint64(hdr.bitrate))
+	}
+	return nil
+}
+
+// MPEG-TS
+
+const (
+	tsPacketSize = 188
+
+	// tsScanLimit bounds the number of packets scanned at the beginning and
+	// at the end of the stream.
+	tsScanLimit = 20000
+)
+
+func isMPEGTS(r io.ReaderAt, size int64) bool {
+	if size < 2*tsPacketSize {
+		return false
+	}
+	for i := int64(0); i < 3 && (i+1)*tsPacketSize <= size; i++ {
+		b, err := readAt(r, i*tsPacketSize, 1)
+		if err != nil || b[0] != 0x47 {
+			return false
+		}
+	}
+	return true
+}
+
+type tsPacket struct {
+	pid     int
+	start   bool
+	pcr     int64 // -1 if not present
+	payload []byte
+}
+
+func parseTSPacket(p []byte) (tsPacket, bool) {
+	if len(p) != tsPacketSize || p[0] != 0x47 {
+		return tsPacket{}, false
+	}
+
+	x := tsPacket{
+		pid:   int(p[1]&0x1f)<<8 | int(p[2]),
+		start: p[1]&0x40 != 0,
+		pcr:   -1,
+	}
+
+	control := p[3] >> 4 & 0x03
+	i := 4
+	if control&0x02 != 0 {
+		n := int(p[4])
+		if 5+n > len(p) {
+			return tsPacket{}, false
+		}
+		if n >= 7 && p[5]&0x10 != 0 {
+			base := int64(p[6])<<25 | int64(p[7])<<17 | int64(p[8])<<9 | int64(p[9])<<1 | int64(p[10]>>7)
+			ext := int64(p[10]&0x01)<<8 | int64(p[11])
+			x.pcr = base*300 + ext
+		}
+		i = 5 + n
+	}
+	if control&0x01 != 0 {
+		x.payload = p[i:]
+	}
+	return x, true
+}
+
+// psiSection returns the section that starts in the payload of the packet.
+// Sections spanning multiple packets are not supported, which is fine for
+// the tables needed here.
+func psiSection(pkt tsPacket) []byte {
+	if !pkt.start || len(pkt.payload) == 0 {
+		return nil
+	}
+	p := pkt.payload
+	start := 1 + int(p[0])
+	if start+3 > len(p) {
+		return nil
+	}
+	s := p[start:]
+	n := int(s[1]&0x0f)<<8 | int(s[2])
+	if 3+n > len(s) || n < 9 {
+		return nil
+	}
+	// Drop the CRC.
+	return s[:3+n-4]
+}
+
+func probeMPEGTS(r io.ReaderAt, size int64, info *MediaInfo) error {
+	packets := size / tsPacketSize
+	pmtPID, pcrPID := -1, -1
+	firstPCR := int64(-1)
+
+	buf := make([]byte, tsPacketSize)
+	for i := int64(0); i < packets && i < tsScanLimit; i++ {
+		if _, err := r.ReadAt(buf, i*tsPacketSize); err != nil {
+			return err
+		}
+		pkt, ok := parseTSPacket(buf)
+		if !ok {
+			return malformed("lost sync at packet %d", i)
+		}
+
+		switch {
+		case pkt.pid == 0 && pmtPID < 0:
+			pmtPID = parsePAT(psiSection(pkt))
+		case pkt.pid == pmtPID && pcrPID < 0:
+			if s := psiSection(pkt); len(s) > 0 && s[0] == 0x02 {
+				pcrPID = parsePMT(s, info)
+			}
+		case pkt.pid == pcrPID && pkt.pcr >= 0:
+			firstPCR = pkt.pcr
+		}
+		if firstPCR >= 0 {
+			break
+		}
+	}
+	if pcrPID < 0 {
+		return malformed("program map table not found")
+	}
+	if firstPCR < 0 {
+		return nil
+	}
+
+	// Find the last PCR, reading the packets backwards in chunks.
+	const chunk = 256
+	chunkBuf := make([]byte, chunk*tsPacketSize)
+	for end := packets; end > packets-tsScanLimit && end > 0; end -= chunk {
+		start := maxInt64(end-chunk, 0)
+		b := chunkBuf[:(end-start)*tsPacketSize]
+		if _, err := r.ReadAt(b, start*tsPacketSize); err != nil {
+			return err
+		}
+		for i := len(b) - tsPacketSize; i >= 0; i -= tsPacketSize {
+			pkt, ok := parseTSPacket(b[i : i+tsPacketSize])
+			if ok && pkt.pid == pcrPID && pkt.pcr >= 0 {
+				d := pkt.pcr - firstPCR
+				if d < 0 {
+					d += (1 << 33) * 300 // wrapped around
+				}
+				info.Duration = scaleDuration(uint64(d), 27000000)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// parsePAT returns the PID of the first program map table listed in the
+// program association table.
+func parsePAT(s []byte) int {
+	if len(s) < 8 || s[0] != 0x00 {
+		return -1
+	}
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := int(s[i])<<8 | int(s[i+1])
+		if program != 0 {
+			return int(s[i+2]&0x1f)<<8 | int(s[i+3])
+		}
+	}
+	return -1
+}
+
+// parsePMT adds the codecs of the streams listed in the program map table
+// and returns the PID carrying the PCR.
+func parsePMT(s []byte, info *MediaInfo) int {
+	if len(s) < 12 {
+		return -1
+	}
+	pcrPID := int(s[8]&0x1f)<<8 | int(s[9])
+
+	i := 12 + (int(s[10]&0x0f)<<8 | int(s[11]))
+	for i+5 <= len(s) {
+		typ := s[i]
+		n := int(s[i+3]&0x0f)<<8 | int(s[i+4])
+		desc := s[i+5 : minInt(i+5+n, len(s))]
+		i += 5 + n
+
+		switch typ {
+		case 0x01:
+			info.VideoCodecs = append(info.VideoCodecs, "mpeg1video")
+		case 0x02:
+			info.VideoCodecs = append(info.VideoCodecs, "mpeg2video")
+		case 0x10:
+			info.VideoCodecs = append(info.VideoCodecs, "mpeg4")
+		case 0x1b:
+			info.VideoCodecs = append(info.VideoCodecs, "h264")
+		case 0x24:
+			info.VideoCodecs = append(info.VideoCodecs, "h265")
+		case 0xea:
+			info.VideoCodecs = append(info.VideoCodecs, "vc1")
+		case 0x03, 0x04:
+			info.AudioCodecs = append(info.AudioCodecs, "mp3")
+		case 0x0f, 0x11:
+			info.AudioCodecs = append(info.AudioCodecs, "aac")
+		case 0x81:
+			info.AudioCodecs = append(info.AudioCodecs, "ac3")
+		case 0x87:
+			info.AudioCodecs = append(info.AudioCodecs, "eac3")
+		case 0x06:
+			// Private data, identified by descriptors. Streams that aren't
+			// recognized are usually subtitles or metadata.
+			if codec := tsPrivateCodec(desc); codec != "" {
+				info.AudioCodecs = append(info.AudioCodecs, codec)
+			}
+		}
+	}
+	return pcrPID
+}
+
+func tsPrivateCodec(desc []byte) string {
+	for i := 0; i+2 <= len(desc); i += 2 + int(desc[i+1]) {
+		tag, data := desc[i], desc[i+2:minInt(i+2+int(desc[i+1]), len(desc))]
+		switch {
+		case tag == 0x6a:
+			return "ac3"
+		case tag == 0x7a:
+			return "eac3"
+		case tag == 0x05 && string(data) == "Opus":
+			return "opus"
+		}
+	}
+	return ""
+}
+
+// Matroska/WebM
+
+const (
+	ebmlHeaderID       = 0x1a45dfa3
+	ebmlDocTypeID      = 0x4282
+	mkvSegmentID       = 0x18538067
+	mkvInfoID          = 0x1549a966
+	mkvTimecodeScaleID = 0x2ad7b1
+	mkvDurationID      = 0x4489
+	mkvTracksID        = 0x1654ae6b
+	mkvTrackEntryID    = 0xae
+	mkvTrackTypeID     = 0x83
+	mkvCodecID         = 0x86
+	mkvClusterID       = 0x1f43b675
+
+	// mkvMaxElementSize bounds the size of the elements loaded into memory.
+	mkvMaxElementSize = 16 << 20
+)
+
+type ebmlElement struct {
+	id   uint32
+	off  int64 // of the data
+	size int64 // -1 if unknown
+}
+
+// readEBMLElement reads the header of the element at the offset.
+func readEBMLElement(r io.ReaderAt, off int64) (ebmlElement, error) {
+	h := make([]byte, 12)
+	n, err := r.ReadAt(h, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ebmlElement{}, err
+	}
+	h = h[:n]
+
+	id, idLen, ok := ebmlVint(h, false)
+	if !ok || idLen > 4 {
+		return ebmlElement{}, malformed("invalid element ID at offset %d", off)
+	}
+	size, sizeLen, ok := ebmlVint(h[idLen:], true)
+	if !ok {
+		return ebmlElement{}, malformed("invalid element size at offset %d", off)
+	}
+	return ebmlElement{
+		id:   uint32(id),
+		off:  off + int64(idLen+sizeLen),
+		size: size,
+	}, nil
+}
+
+// ebmlVint decodes a variable-length integer. IDs keep the length marker,
+// sizes don't; a size with all the bits set is unknown and returned as -1.
+func ebmlVint(b []byte, isSize bool) (int64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > len(b) {
+		return 0, 0, false
+	}
+
+	v := uint64(b[0])
+	if isSize {
+		v &= uint64(0xff >> n)
+	}
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	if isSize && v == 1<<(7*n)-1 {
+		return -1, n, true
+	}
+	if v > math.MaxInt64 {
+		return 0, 0, false
+	}
+	return int64(v), n, true
+}
+
+// parseEBML calls fn for all the child elements in the data, which is a
+// loaded master element.
+func parseEBML(d []byte, fn func(id uint32, data []byte) error) error {
+	r := bytes.NewReader(d)
+	for off := int64(0); off < int64(len(d)); {
+		e, err := readEBMLElement(r, off)
+		if err != nil {
+			return err
+		}
+		if e.size < 0 || e.off+e.size > int64(len(d)) {
+			return malformed("element %#x exceeds its parent", e.id)
+		}
+		if err := fn(e.id, d[e.off:e.off+e.size]); err != nil {
+			return err
+		}
+		off = e.off + e.size
+	}
+	return nil
+}
+
+func loadEBML(r io.ReaderAt, e ebmlElement) ([]byte, error) {
+	if e.size < 0 || e.size > mkvMaxElementSize {
+		return nil, malformed("element %#x is too large", e.id)
+	}
+	return readAt(r, e.off, int(e.size))
+}
+
+func ebmlUint(d []byte) uint64 {
+	var v uint64
+	for _, c := range d {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func probeMatroska(r io.ReaderAt, size int64, info *MediaInfo) error {
+	header, err := readEBMLElement(r, 0)
+	if err != nil {
+		return err
+	}
+	d, err := loadEBML(r, header)
+	if err != nil {
+		return err
+	}
+	err = parseEBML(d, func(id uint32, data []byte) error {
+		if id == ebmlDocTypeID && string(bytes.TrimRight(data, "\x00")) == "webm" {
+			info.Container = "webm"
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	segment, err := readEBMLElement(r, header.off+header.size)
+	if err != nil {
+		return err
+	}
+	if segment.id != mkvSegmentID {
+		return malformed("segment not found")
+	}
+	end := size
+	if segment.size >= 0 && segment.off+segment.size < end {
+		end = segment.off + segment.size
+	}
+
+	var scale uint64 = 1000000
+	var duration float64
+	var hasInfo, hasTracks bool
+
+	for off := segment.off; off < end && !(hasInfo && hasTracks); {
+		e, err := readEBMLElement(r, off)
+		if err != nil {
+			return err
+		}
+
+		switch e.id {
+		case mkvInfoID:
+			d, err := loadEBML(r, e)
+			if err != nil {
+				return err
+			}
+			err = parseEBML(d, func(id uint32, data []byte) error {
+				switch id {
+				case mkvTimecodeScaleID:
+					scale = ebmlUint(data)
+				case mkvDurationID:
+					switch len(data) {
+					case 4:
+						duration = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+					case 8:
+						duration = math.Float64frombits(binary.BigEndian.Uint64(data))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			hasInfo = true
+		case mkvTracksID:
+			d, err := loadEBML(r, e)
+			if err != nil {
+				return err
+			}
+			if err := parseEBML(d, func(id uint32, data []byte) error {
+				if id == mkvTrackEntryID {
+					return probeMatroskaTrack(data, info)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			hasTracks = true
+		}
+
+		if e.size < 0 {
+			// Typically a live stream's cluster, the headers must precede
+			// it.
+			break
+		}
+		off = e.off + e.size
+	}
+
+	if !hasTracks {
+		return malformed("tracks not found")
+	}
+	if duration > 0 && !math.IsInf(duration, 0) {
+		info.Duration = time.Duration(duration * float64(scale))
+	}
+	return nil
+}
+
+func probeMatroskaTrack(d []byte, info *MediaInfo) error {
+	var typ uint64
+	var codec string
+	err := parseEBML(d, func(id uint32, data []byte) error {
+		switch id {
+		case mkvTrackTypeID:
+			typ = ebmlUint(data)
+		case mkvCodecID:
+			codec = matroskaCodec(string(bytes.TrimRight(data, "\x00")))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case 1:
+		info.VideoCodecs = append(info.VideoCodecs, codec)
+	case 2:
+		info.AudioCodecs = append(info.AudioCodecs, codec)
+	}
+	return nil
+}
+
+func matroskaCodec(id string) string {
+	prefixes := []struct{ prefix, codec string }{
+		{"V_MPEG4/ISO/AVC", "h264"},
+		{"V_MPEGH/ISO/HEVC", "h265"},
+		{"V_MPEG4/", "mpeg4"},
+		{"V_VP8", "vp8"},
+		{"V_VP9", "vp9"},
+		{"V_AV1", "av1"},
+		{"A_AAC", "aac"},
+		{"A_OPUS", "opus"},
+		{"A_VORBIS", "vorbis"},
+		{"A_MPEG/L3", "mp3"},
+		{"A_MPEG/L2", "mp2"},
+		{"A_AC3", "ac3"},
+		{"A_EAC3", "eac3"},
+		{"A_FLAC", "flac"},
+		{"A_PCM/", "pcm"},
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(id, p.prefix) {
+			return p.codec
+		}
+	}
+	return strings.ToLower(id)
+}
+
+// minInt and maxInt64 stand in for the built-in min and max, which require
+// Go 1.21.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
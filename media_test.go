@@ -0,0 +1,335 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// MP4
+
+func testMP4Box(typ string, payload ...[]byte) []byte {
+	d := concat(payload...)
+	return concat(u32(uint32(8+len(d))), []byte(typ), d)
+}
+
+func mp4Movie(brand string, scale, duration uint32, traks ...[]byte) []byte {
+	mvhd := testMP4Box("mvhd", make([]byte, 12), u32(scale), u32(duration), make([]byte, 80))
+	return concat(
+		testMP4Box("ftyp", []byte(brand), u32(0)),
+		testMP4Box("moov", append([][]byte{mvhd}, traks...)...),
+		testMP4Box("mdat", make([]byte, 16)),
+	)
+}
+
+func mp4Trak(handler string, entry []byte) []byte {
+	hdlr := testMP4Box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 12))
+	stsd := testMP4Box("stsd", u32(0), u32(1), entry)
+	return testMP4Box("trak", testMP4Box("mdia", hdlr, testMP4Box("minf", testMP4Box("stbl", stsd))))
+}
+
+func mp4aEntry(objectType byte) []byte {
+	dc := []byte{0x04, 13, objectType, 0x15}
+	dc = append(dc, make([]byte, 11)...)
+	es := concat([]byte{0x03, byte(3 + len(dc))}, u16(1), []byte{0}, dc)
+	return testMP4Box("mp4a", make([]byte, 28), testMP4Box("esds", u32(0), es))
+}
+
+// WAV
+
+func wavFile(format uint16, byteRate uint32, dataSize int) []byte {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk, format)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], byteRate)
+
+	var b []byte
+	b = append(b, "RIFF"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+24+8+dataSize))
+	b = append(b, "WAVE"...)
+	b = append(b, "fmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = append(b, fmtChunk...)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(dataSize))
+	return append(b, make([]byte, dataSize)...)
+}
+
+// ADTS and MP3
+
+// adtsStream returns frames of 1024 samples at 8 kHz, 0.128s each.
+func adtsStream(frames int) []byte {
+	const size = 16
+	frame := make([]byte, size)
+	copy(frame, []byte{0xff, 0xf1, 0x40 | 11<<2, 0x80 | size>>11, size >> 3 & 0xff, size&0x07<<5 | 0x1f, 0xfc})
+	return bytes.Repeat(frame, frames)
+}
+
+func id3Tag(size int) []byte {
+	return concat([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(size)}, make([]byte, size))
+}
+
+// mp3Stream returns an MPEG-1 layer III stream at 48 kHz and 128 kbps of
+// the given size, with a Xing header declaring the number of frames if it's
+// not zero.
+func mp3Stream(size int, frames uint32) []byte {
+	b := make([]byte, size)
+	copy(b, []byte{0xff, 0xfb, 9<<4 | 1<<2, 0x00})
+	if frames > 0 {
+		copy(b[4+32:], concat([]byte("Xing"), u32(1), u32(frames)))
+	}
+	return b
+}
+
+// MPEG-TS
+
+func tsPacketBytes(pid int, start bool, adaptation, payload []byte) []byte {
+	p := bytes.Repeat([]byte{0xff}, tsPacketSize)
+	p[0] = 0x47
+	p[1] = byte(pid >> 8 & 0x1f)
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	p[3] = 0
+
+	i := 4
+	if adaptation != nil {
+		p[3] |= 0x20
+		p[4] = byte(len(adaptation))
+		copy(p[5:], adaptation)
+		i = 5 + len(adaptation)
+	}
+	if payload != nil {
+		p[3] |= 0x10
+		copy(p[i:], payload)
+	}
+	return p
+}
+
+func tsSection(tableID byte, id uint16, data []byte) []byte {
+	n := 5 + len(data) + 4
+	return concat([]byte{0, tableID, 0xb0 | byte(n>>8), byte(n)}, u16(id), []byte{0xc1, 0, 0}, data, u32(0))
+}
+
+func tsPCR(seconds int) []byte {
+	base := uint64(seconds) * 90000
+	return []byte{0x10, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base&1<<7 | 0x7e), 0}
+}
+
+func tsStream(streamTypes []byte, seconds int) []byte {
+	const pmtPID, pcrPID = 0x100, 0x101
+
+	var streams []byte
+	for i, typ := range streamTypes {
+		streams = append(streams, typ, 0xe1, byte(0x02+i), 0xf0, 0)
+	}
+
+	return concat(
+		tsPacketBytes(0, true, nil, tsSection(0x00, 1, concat(u16(1), u16(0xe000|pmtPID)))),
+		tsPacketBytes(pmtPID, true, nil, tsSection(0x02, 1, concat(u16(0xe000|pcrPID), u16(0xf000), streams))),
+		tsPacketBytes(pcrPID, false, tsPCR(0), nil),
+		tsPacketBytes(0x1fff, false, nil, []byte{}),
+		tsPacketBytes(pcrPID, false, tsPCR(seconds), nil),
+		tsPacketBytes(0x1fff, false, nil, []byte{}),
+	)
+}
+
+// Matroska
+
+func ebml(id uint32, payload ...[]byte) []byte {
+	d := concat(payload...)
+
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> shift); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(d)))
+	size[0] = 0x01
+	return concat(b, size, d)
+}
+
+func mkvFile(docType string, seconds float64, tracks ...[]byte) []byte {
+	return concat(
+		ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte(docType))),
+		ebml(mkvSegmentID,
+			ebml(mkvInfoID,
+				ebml(mkvTimecodeScaleID, u32(1000000)),
+				ebml(mkvDurationID, binary.BigEndian.AppendUint64(nil, math.Float64bits(seconds*1000)))),
+			ebml(mkvTracksID, tracks...),
+			ebml(mkvClusterID, make([]byte, 16))),
+	)
+}
+
+func mkvTrack(typ byte, codec string) []byte {
+	return ebml(mkvTrackEntryID, ebml(mkvTrackTypeID, []byte{typ}), ebml(mkvCodecID, []byte(codec)))
+}
+
+func TestProbeMedia(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		want   MediaInfo
+		reason string // substring of the Reason
+	}{
+		{
+			name: "mp4",
+			data: mp4Movie("isom", 1000, 10000, mp4Trak("soun", mp4aEntry(0x40)), mp4Trak("vide", testMP4Box("avc1"))),
+			want: MediaInfo{Container: "mp4", AudioCodecs: []string{"aac"}, VideoCodecs: []string{"h264"}, Duration: 10 * time.Second, Fingerprintable: true},
+		},
+		{
+			name:   "mov with mp3",
+			data:   mp4Movie("qt  ", 600, 1800, mp4Trak("soun", mp4aEntry(0x6b))),
+			want:   MediaInfo{Container: "mov", AudioCodecs: []string{"mp3"}, Duration: 3 * time.Second},
+			reason: "no supported stream",
+		},
+		{
+			name:   "mp4 too short",
+			data:   mp4Movie("isom", 1000, 500, mp4Trak("vide", testMP4Box("hvc1"))),
+			want:   MediaInfo{Container: "mp4", VideoCodecs: []string{"h265"}, Duration: 500 * time.Millisecond},
+			reason: "longer than 1 second",
+		},
+		{
+			name:   "mp4 without moov",
+			data:   concat(testMP4Box("ftyp", []byte("isom"), u32(0)), testMP4Box("mdat", make([]byte, 16))),
+			want:   MediaInfo{Container: "mp4"},
+			reason: "moov box not found",
+		},
+		{
+			name:   "mp4 truncated",
+			data:   mp4Movie("isom", 1000, 10000, mp4Trak("soun", mp4aEntry(0x40)))[:100],
+			want:   MediaInfo{Container: "mp4"},
+			reason: "malformed mp4",
+		},
+		{
+			name: "wav",
+			data: wavFile(0x00ff, 1000, 3000),
+			want: MediaInfo{Container: "wav", AudioCodecs: []string{"aac"}, Duration: 3 * time.Second, Fingerprintable: true},
+		},
+		{
+			name:   "wav with pcm",
+			data:   wavFile(0x0001, 1000, 2000),
+			want:   MediaInfo{Container: "wav", AudioCodecs: []string{"pcm"}, Duration: 2 * time.Second},
+			reason: "no supported stream",
+		},
+		{
+			name: "adts",
+			data: adtsStream(16),
+			want: MediaInfo{Container: "adts", AudioCodecs: []string{"aac"}, Duration: 2048 * time.Millisecond, Fingerprintable: true},
+		},
+		{
+			name: "adts with id3",
+			data: concat(id3Tag(20), adtsStream(16)),
+			want: MediaInfo{Container: "adts", AudioCodecs: []string{"aac"}, Duration: 2048 * time.Millisecond, Fingerprintable: true},
+		},
+		{
+			name:   "mp3 cbr",
+			data:   mp3Stream(32000, 0),
+			want:   MediaInfo{Container: "mp3", AudioCodecs: []string{"mp3"}, Duration: 2 * time.Second},
+			reason: "no supported stream",
+		},
+		{
+			name:   "mp3 vbr",
+			data:   mp3Stream(1000, 125),
+			want:   MediaInfo{Container: "mp3", AudioCodecs: []string{"mp3"}, Duration: 3 * time.Second},
+			reason: "no supported stream",
+		},
+		{
+			name: "mpegts",
+			data: tsStream([]byte{0x0f, 0x1b}, 5),
+			want: MediaInfo{Container: "mpegts", AudioCodecs: []string{"aac"}, VideoCodecs: []string{"h264"}, Duration: 5 * time.Second, Fingerprintable: true},
+		},
+		{
+			name:   "mpegts without pmt",
+			data:   bytes.Repeat(tsPacketBytes(0x1fff, false, nil, []byte{}), 4),
+			want:   MediaInfo{Container: "mpegts"},
+			reason: "program map table not found",
+		},
+		{
+			name: "matroska",
+			data: mkvFile("matroska", 2.5, mkvTrack(1, "V_MPEG4/ISO/AVC"), mkvTrack(2, "A_AAC/MPEG4/LC")),
+			want: MediaInfo{Container: "matroska", AudioCodecs: []string{"aac"}, VideoCodecs: []string{"h264"}, Duration: 2500 * time.Millisecond, Fingerprintable: true},
+		},
+		{
+			name:   "webm",
+			data:   mkvFile("webm", 4, mkvTrack(1, "V_VP9"), mkvTrack(2, "A_OPUS")),
+			want:   MediaInfo{Container: "webm", AudioCodecs: []string{"opus"}, VideoCodecs: []string{"vp9"}, Duration: 4 * time.Second},
+			reason: "no supported stream",
+		},
+		{
+			name:   "unrecognized",
+			data:   []byte("hello world, this is not media"),
+			want:   MediaInfo{},
+			reason: "unrecognized media format",
+		},
+		{
+			name:   "empty",
+			data:   nil,
+			want:   MediaInfo{},
+			reason: "unrecognized media format",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProbeMediaBuffer(tt.data)
+			if err != nil {
+				t.Fatalf("ProbeMediaBuffer: %v", err)
+			}
+
+			if !strings.Contains(got.Reason, tt.reason) || (tt.reason == "") != got.Fingerprintable {
+				t.Errorf("Reason = %q, want it to contain %q", got.Reason, tt.reason)
+			}
+			got.Reason = ""
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ProbeMediaBuffer = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+type errReaderAt struct{ err error }
+
+func (x errReaderAt) ReadAt([]byte, int64) (int, error) { return 0, x.err }
+
+func TestProbeMediaErrors(t *testing.T) {
+	want := errors.New("read failed")
+	if _, err := ProbeMedia(errReaderAt{want}, 1000); !errors.Is(err, want) {
+		t.Errorf("ProbeMedia: got error %v, want %v", err, want)
+	}
+
+	if _, err := ProbeMediaFile(filepath.Join(t.TempDir(), "missing.mp4")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ProbeMediaFile: got error %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestProbeMediaFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.aac")
+	if err := os.WriteFile(path, adtsStream(16), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ProbeMediaFile(path)
+	if err != nil {
+		t.Fatalf("ProbeMediaFile: %v", err)
+	}
+	if !info.Fingerprintable || info.Duration != 2048*time.Millisecond {
+		t.Errorf("ProbeMediaFile = %+v, want a fingerprintable media of 2.048s", info)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Option configures a client. Options are passed to NewPexSearchClient and
+// NewPrivateSearchClient and apply to every operation performed by the
+// created client.
+type Option func(*options)
+
+type options struct {
+	logger      Logger
+	retryPolicy *RetryPolicy
+	timeout     time.Duration
+	hooks       Hooks
+	searchType  PexSearchType
+	pollPolicy  PollPolicy
+
+	readerMemoryLimit int64
+	ffmpegPath        string
+	cache             *FingerprintCache
+	sourceMetadata    bool
+	preflight         bool
+}
+
+func newOptions(opts []Option) *options {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Logger is used by the clients to report what's going on, e.g. when an
+// operation is retried. It's satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// WithLogger sets the logger used by the client. Nothing is logged by
+// default.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithRetryPolicy sets the policy used to retry idempotent operations that
+// failed with a retryable error. Operations are not retried by default.
+// The policy is copied, including its Overrides, so changing it afterwards
+// doesn't affect the client.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	if policy.Overrides != nil {
+		overrides := make(map[StatusCode]RetryOverride, len(policy.Overrides))
+		for code, o := range policy.Overrides {
+			overrides[code] = o
+		}
+		policy.Overrides = overrides
+	}
+	return func(o *options) {
+		o.retryPolicy = &policy
+	}
+}
+
+// WithDefaultTimeout sets the timeout applied to every operation whose
+// context doesn't already have a deadline. Operations started by the
+// functions that don't accept a context are subject to it as well.
+func WithDefaultTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithHooks sets callbacks that are invoked around every operation, which
+// is useful e.g. for collecting metrics.
+func WithHooks(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+// WithDefaultSearchType sets the type used by PexSearchClient.StartSearch
+// for requests that leave PexSearchRequest.Type unset. Requests can still
+// ask for the default of the native library using NativeDefaultSearchType.
+func WithDefaultSearchType(typ PexSearchType) Option {
+	return func(o *options) {
+		o.searchType = typ
+	}
+}
+
+// Hooks holds callbacks that are invoked around every operation performed by
+// a client. The operation is identified by the name of the method that
+// started it, e.g. "StartSearch". Any of the callbacks may be nil.
+type Hooks struct {
+	// OnStart is called before the operation starts.
+	OnStart func(op string)
+
+	// OnFinish is called after the operation finishes, including all of its
+	// retries.
+	OnFinish func(op string, duration time.Duration, err error)
+
+	// OnAttempt is called after every attempt to perform the operation.
+	// Attempts are numbered from 1.
+	OnAttempt func(op string, attempt int, duration time.Duration, err error)
+
+	// OnRetry is called when a failed attempt is going to be retried after
+	// the given backoff.
+	OnRetry func(op string, attempt int, backoff time.Duration, err error)
+}
+
+// RetryPolicy specifies how idempotent operations that failed with a
+// retryable error (see Error.IsRetryable) are retried. The idempotent
+// operations are CheckSearch (and thus the Get methods of the futures),
+// Ingest, Archive and Lister.List. A CheckSearch that fails because the
+// result is not ready yet is left to the futures, see PollPolicy.
+//
+// StartSearch is not retried: an attempt that fails, e.g. because of a
+// timeout, may still have started the search on the backend, so retrying
+// it could start a duplicate search, which is billed as well.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. Values lower than 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. It is doubled
+	// after every subsequent attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts. Zero means no cap.
+	MaxBackoff time.Duration
+
+	// Jitter randomly shortens every delay by up to the given fraction of
+	// it, so that clients that failed at the same time don't retry at the
+	// same time either, e.g. 0.2 shortens the delays by up to 20%. Values
+	// above 1 are treated as 1, zero and negative values disable jitter.
+	Jitter float64
+
+	// Budget limits the total time spent on an operation, including all of
+	// its attempts and the delays between them: an attempt still running
+	// when the budget runs out fails with context.DeadlineExceeded, and an
+	// attempt isn't retried if the delay would exceed the budget. Zero means
+	// no limit.
+	Budget time.Duration
+
+	// Overrides change how errors with the given status codes are retried,
+	// regardless of Error.IsRetryable.
+	Overrides map[StatusCode]RetryOverride
+}
+
+// RetryOverride changes how errors with a particular status code are
+// retried, see RetryPolicy.Overrides.
+type RetryOverride struct {
+	// Retry specifies whether the errors are retried.
+	Retry bool
+
+	// InitialBackoff, if set, is used instead of RetryPolicy.InitialBackoff.
+	InitialBackoff time.Duration
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func (x *RetryPolicy) backoff(attempt int, err error) time.Duration {
+	d := x.InitialBackoff
+	if o, ok := x.override(err); ok && o.InitialBackoff > 0 {
+		d = o.InitialBackoff
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if x.MaxBackoff > 0 && d >= x.MaxBackoff {
+			break
+		}
+	}
+	if x.MaxBackoff > 0 && d > x.MaxBackoff {
+		d = x.MaxBackoff
+	}
+	return x.jitter(d)
+}
+
+func (x *RetryPolicy) jitter(d time.Duration) time.Duration {
+	if x.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	f := x.Jitter
+	if f > 1 {
+		f = 1
+	}
+
+	jitterMu.Lock()
+	r := jitterRand.Float64()
+	jitterMu.Unlock()
+
+	return d - time.Duration(f*r*float64(d))
+}
+
+func (x *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if attempt >= x.MaxAttempts {
+		return false
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	if o, ok := x.override(err); ok {
+		return o.Retry
+	}
+	// Results that aren't ready are polled for by the futures, see
+	// PollPolicy.
+	return e.IsRetryable && !isNotReady(err)
+}
+
+func (x *RetryPolicy) override(err error) (RetryOverride, bool) {
+	var e *Error
+	if !errors.As(err, &e) {
+		return RetryOverride{}, false
+	}
+	o, ok := x.Overrides[e.Code]
+	return o, ok
+}
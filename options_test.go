@@ -0,0 +1,121 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retryable := &Error{Code: StatusConnectionError, IsRetryable: true}
+	overridden := &Error{Code: StatusResourceExhausted, IsRetryable: true}
+
+	policy := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Overrides: map[StatusCode]RetryOverride{
+			StatusResourceExhausted: {Retry: true, InitialBackoff: 300 * time.Millisecond},
+		},
+	}
+
+	tests := []struct {
+		attempt int
+		err     error
+		want    time.Duration
+	}{
+		{1, retryable, 100 * time.Millisecond},
+		{2, retryable, 200 * time.Millisecond},
+		{3, retryable, 400 * time.Millisecond},
+		{4, retryable, 800 * time.Millisecond},
+		{5, retryable, time.Second},
+		{100, retryable, time.Second},
+		{1, overridden, 300 * time.Millisecond},
+		{2, overridden, 600 * time.Millisecond},
+		{3, overridden, time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.backoff(tt.attempt, tt.err); got != tt.want {
+			t.Errorf("backoff(%d, %v) = %v, want %v", tt.attempt, tt.err, got, tt.want)
+		}
+	}
+
+	// Without a cap, the backoff keeps growing.
+	policy.MaxBackoff = 0
+	if got, want := policy.backoff(8, retryable), 12800*time.Millisecond; got != want {
+		t.Errorf("backoff(8) without a cap = %v, want %v", got, want)
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	const d = time.Second
+
+	tests := []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0, d, d},
+		{-1, d, d},
+		{0.2, 800 * time.Millisecond, d},
+		{1, 0, d},
+		{5, 0, d},
+	}
+	for _, tt := range tests {
+		policy := &RetryPolicy{Jitter: tt.jitter}
+		for i := 0; i < 1000; i++ {
+			if got := policy.jitter(d); got < tt.min || got > tt.max {
+				t.Errorf("jitter(%v) with Jitter %v = %v, want between %v and %v", d, tt.jitter, got, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := &RetryPolicy{
+		MaxAttempts: 3,
+		Overrides: map[StatusCode]RetryOverride{
+			StatusResourceExhausted: {Retry: false},
+			StatusInternalError:     {Retry: true},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		attempt int
+		err     error
+		want    bool
+	}{
+		{"retryable", 1, &Error{Code: StatusConnectionError, IsRetryable: true}, true},
+		{"last attempt", 3, &Error{Code: StatusConnectionError, IsRetryable: true}, false},
+		{"not retryable", 1, &Error{Code: StatusInvalidInput}, false},
+		{"not an Error", 1, errors.New("fail"), false},
+		{"override disables", 1, &Error{Code: StatusResourceExhausted, IsRetryable: true}, false},
+		{"override enables", 1, &Error{Code: StatusInternalError}, true},
+		{"override on last attempt", 3, &Error{Code: StatusInternalError}, false},
+		{"not ready", 1, &Error{Code: StatusLookupTimedOut, IsRetryable: true}, false},
+	}
+	for _, tt := range tests {
+		if got := policy.shouldRetry(tt.attempt, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRetry(%d, %v) = %v, want %v", tt.name, tt.attempt, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWithRetryPolicyCopiesOverrides(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		Overrides: map[StatusCode]RetryOverride{
+			StatusInternalError: {Retry: true},
+		},
+	}
+	opts := newOptions([]Option{WithRetryPolicy(policy)})
+
+	policy.Overrides[StatusInternalError] = RetryOverride{Retry: false}
+	policy.MaxAttempts = 1
+
+	if !opts.retryPolicy.shouldRetry(1, &Error{Code: StatusInternalError}) {
+		t.Error("changing the policy after WithRetryPolicy affected the client")
+	}
+}
@@ -8,8 +8,10 @@ package pex
 // #include <stdlib.h>
 import "C"
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 	"unsafe"
 )
 
@@ -25,8 +27,26 @@ const (
 	// FindMatches is a type of PexSearch that will return all assets that
 	// matched against the given media file.
 	FindMatches = PexSearchType(C.Pex_SearchType_FindMatches)
+
+	// NativeDefaultSearchType explicitly requests the default type of the
+	// native library, which is what the zero value meant before
+	// WithDefaultSearchType was introduced. Unlike the zero value, it's not
+	// replaced by the type set using WithDefaultSearchType.
+	NativeDefaultSearchType = PexSearchType(-1)
 )
 
+// resolveSearchType returns the type passed to the native library for the
+// requested type.
+func (x *options) resolveSearchType(typ PexSearchType) PexSearchType {
+	if typ == 0 {
+		typ = x.searchType
+	}
+	if typ == NativeDefaultSearchType {
+		typ = 0
+	}
+	return typ
+}
+
 // PexSearchRequest holds all data necessary to perform a pex search. A search can only be
 // performed using a fingerprint, but additional parameters may be supported in
 // the future.
@@ -36,7 +56,9 @@ type PexSearchRequest struct {
 	Fingerprint *Fingerprint
 
 	// Type is optional and when specified will allow to retrieve results that
-	// are more relevant to the given use-case.
+	// are more relevant to the given use-case. When left unset, the type set
+	// using WithDefaultSearchType is used. Use NativeDefaultSearchType to
+	// request the default of the native library regardless.
 	Type PexSearchType
 }
 
@@ -54,6 +76,10 @@ type PexSearchResult struct {
 
 	// The content classification of the query file, e.g. "music", "silence", "speech".
 	ContentClassification ContentClassification `json:"content_classification"`
+
+	// The fingerprint of the query, only set by SearchFile and SearchBuffer
+	// when SearchOptions.ReturnFingerprint is true.
+	Fingerprint *Fingerprint `json:"-"`
 }
 
 type PexSearchAsset struct {
@@ -101,16 +127,91 @@ type PexSearchMatch struct {
 // PexSearchFuture object is returned by the PexSearchClient.StartSearch
 // function and is used to retrieve a search result.
 type PexSearchFuture struct {
-	client *PexSearchClient
+	f *future[*PexSearchResult]
 
 	LookupIDs []string
+
+	// Type is the type of the search, including the default set by
+	// WithDefaultSearchType.
+	Type PexSearchType
+
+	// StartedAt is the time the search was started.
+	StartedAt time.Time
+
+	// FingerprintMetadata is the metadata of the searched fingerprint. Its
+	// Offset is needed to call ShiftQuery on the result of a range search.
+	FingerprintMetadata FingerprintMetadata
 }
 
-// Get blocks until the search result is ready and then returns it. It
-// also releases all the allocated resources, so it will return an
-// error when called multiple times.
+// NewPexSearchFuture creates a future that retrieves the result of the
+// search identified by the lookup IDs using the given searcher. Only the
+// WithPollPolicy option applies to the future.
+func NewPexSearchFuture(searcher PexSearcher, lookupIDs []string, opts ...Option) *PexSearchFuture {
+	return newPexSearchFuture(searcher, lookupIDs, newOptions(opts).pollPolicy)
+}
+
+func newPexSearchFuture(searcher PexSearcher, lookupIDs []string, policy PollPolicy) *PexSearchFuture {
+	return &PexSearchFuture{
+		f: newFuture(func(ctx context.Context) (*PexSearchResult, error) {
+			return searcher.CheckSearchContext(ctx, lookupIDs)
+		}, policy),
+		LookupIDs: lookupIDs,
+	}
+}
+
+// Get blocks until the search result is ready and then returns it. The
+// outcome is retrieved only once, so calling Get again returns the same
+// result or error right away.
 func (x *PexSearchFuture) Get() (*PexSearchResult, error) {
-	return x.client.CheckSearch(x.LookupIDs)
+	return x.GetContext(context.Background())
+}
+
+// GetContext is like Get but returns ctx.Err() as soon as the context
+// is done. The polling continues in the background.
+func (x *PexSearchFuture) GetContext(ctx context.Context) (*PexSearchResult, error) {
+	return x.f.GetContext(ctx)
+}
+
+// Done returns a channel that's closed when the outcome of the search is
+// known. It starts polling for the result in the background.
+func (x *PexSearchFuture) Done() <-chan struct{} {
+	return x.f.Done()
+}
+
+// Wait blocks until the outcome of the search is known and returns the
+// error of the search, if any. It returns ctx.Err() as soon as the context
+// is done.
+func (x *PexSearchFuture) Wait(ctx context.Context) error {
+	return x.f.Wait(ctx)
+}
+
+// TryGet returns the result without blocking. The returned bool is false if
+// the outcome of the search is not known yet. It starts polling for the
+// result in the background.
+func (x *PexSearchFuture) TryGet() (*PexSearchResult, bool, error) {
+	return x.f.TryGet()
+}
+
+// Cancel stops polling for the result, after which Get returns
+// context.Canceled, unless the outcome was already known. The search
+// itself is not canceled on the backend.
+func (x *PexSearchFuture) Cancel() {
+	x.f.Cancel()
+}
+
+// MarshalJSON encodes the future, so that the search can be resumed later,
+// possibly by another process, using PexSearchClient.ResumeSearch. The result
+// is not part of the encoded future. There's no UnmarshalJSON, since the
+// future needs a client to poll for the result: decode it using
+// ResumeSearch. A future decoded otherwise fails right away.
+func (x *PexSearchFuture) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&persistedFuture{
+		Kind:        searchKindPex,
+		LookupIDs:   x.LookupIDs,
+		SearchType:  x.Type,
+		StartedAt:   x.StartedAt,
+		Fingerprint: newFingerprintFileMetadata(x.FingerprintMetadata),
+	})
 }
 
 // PexSearchClient serves as an entry point to all operations that
@@ -119,76 +220,116 @@ func (x *PexSearchFuture) Get() (*PexSearchResult, error) {
 // service.
 type PexSearchClient struct {
 	fingerprinter
+}
 
-	c *C.Pex_Client
+// NewPexSearchClient initializes a new client and authenticates it
+// using the given credentials. The options are applied to every
+// operation performed by the client.
+func NewPexSearchClient(clientID, clientSecret string, opts ...Option) (*PexSearchClient, error) {
+	return NewPexSearchClientWithCredentials(context.Background(), StaticCredentials(clientID, clientSecret), opts...)
 }
 
-func NewPexSearchClient(clientID, clientSecret string) (*PexSearchClient, error) {
-	cClient, err := newClient(C.Pex_PEX_SEARCH, clientID, clientSecret)
+// NewPexSearchClientWithCredentials is like NewPexSearchClient, but
+// retrieves the credentials from the given provider. The provider is
+// consulted again whenever the backend rejects the current credentials,
+// or when RefreshCredentials is called, so that rotated credentials are
+// picked up without re-creating the client.
+func NewPexSearchClientWithCredentials(ctx context.Context, provider CredentialsProvider, opts ...Option) (*PexSearchClient, error) {
+	c, err := newClient(ctx, C.Pex_PEX_SEARCH, provider, opts)
 	if err != nil {
 		return nil, err
 	}
 	return &PexSearchClient{
 		fingerprinter: fingerprinter{
-			c: cClient,
+			client: c,
 		},
-		c: cClient,
 	}, nil
 }
 
 // Close closes all connections to the backend service and releases
-// the memory manually allocated by the core library.
+// the memory manually allocated by the core library. The core library
+// itself is only cleaned up once all the clients are closed. Close
+// waits for all the in-flight operations to finish. It's safe to call
+// it multiple times, even concurrently, and every call returns only
+// after the client is fully closed. All the operations performed on the
+// client after it was closed return ErrClientClosed.
 func (x *PexSearchClient) Close() error {
-	return closeClient(&x.c)
+	return x.close()
+}
+
+// RefreshCredentials retrieves the credentials from the provider and, if
+// they changed, re-initializes the client with them. The operations started
+// afterwards use the new credentials right away, RefreshCredentials then
+// waits for the operations that were already in flight to finish, so that
+// the old credentials can be released. If the context is done first, it
+// returns ctx.Err() and the old credentials are released in the
+// background.
+func (x *PexSearchClient) RefreshCredentials(ctx context.Context) error {
+	_, err := x.refresh(ctx)
+	return err
 }
 
 func (x *PexSearchClient) getCClient() *C.Pex_Client {
-	return x.c
+	return x.native()
 }
 
 // StartSearch starts a Pex search. This operation does not block until
 // the search is finished, it does however perform a network operation
 // to initiate the search on the backend service.
 func (x *PexSearchClient) StartSearch(req *PexSearchRequest) (*PexSearchFuture, error) {
-	C.Pex_Lock()
-	defer C.Pex_Unlock()
+	return x.StartSearchContext(context.Background(), req)
+}
+
+// StartSearchContext is like StartSearch but returns ctx.Err() as soon
+// as the context is done.
+func (x *PexSearchClient) StartSearchContext(ctx context.Context, req *PexSearchRequest) (*PexSearchFuture, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	return call(ctx, x.client, "StartSearch", false, func(ctx context.Context, c *C.Pex_Client) (*PexSearchFuture, error) {
+		return x.startSearch(ctx, c, req)
+	})
+}
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+func (x *PexSearchClient) startSearch(ctx context.Context, c *C.Pex_Client, req *PexSearchRequest) (*PexSearchFuture, error) {
+	if err := lockContext(ctx); err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
+	defer C.Pex_Unlock()
 
-	cRequest := C.Pex_StartSearchRequest_New()
-	if cRequest == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cStatus, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_StartSearchRequest_Delete(&cRequest)
 
-	cResult := C.Pex_StartSearchResult_New()
-	if cResult == nil {
-		panic("out of memory")
+	cRequest, err := a.startSearchRequest()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_StartSearchResult_Delete(&cResult)
 
-	cBuffer := C.Pex_Buffer_New()
-	if cBuffer == nil {
-		panic("out of memory")
+	cResult, err := a.startSearchResult()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Buffer_Delete(&cBuffer)
 
-	ftData := unsafe.Pointer(&req.Fingerprint.b[0])
-	ftSize := C.size_t(len(req.Fingerprint.b))
+	cBuffer, err := a.bufferFrom(req.Fingerprint.b)
+	if err != nil {
+		return nil, err
+	}
 
-	C.Pex_Buffer_Set(cBuffer, ftData, ftSize)
+	typ := x.opts.resolveSearchType(req.Type)
 
-	C.Pex_StartSearchRequest_SetType(cRequest, C.Pex_SearchType(req.Type))
+	C.Pex_StartSearchRequest_SetType(cRequest, C.Pex_SearchType(typ))
 	C.Pex_StartSearchRequest_SetFingerprint(cRequest, cBuffer, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
 
-	C.Pex_StartSearch(x.c, cRequest, cResult, cStatus)
+	C.Pex_StartSearch(c, cRequest, cResult, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
@@ -201,33 +342,71 @@ func (x *PexSearchClient) StartSearch(req *PexSearchRequest) (*PexSearchFuture,
 		lookupIDs = append(lookupIDs, C.GoString(cLookupID))
 	}
 
-	return &PexSearchFuture{
-		client:    x,
-		LookupIDs: lookupIDs,
-	}, nil
+	fut := newPexSearchFuture(x, lookupIDs, x.opts.pollPolicy)
+	fut.Type = typ
+	fut.StartedAt = time.Now().UTC()
+	fut.FingerprintMetadata = req.Fingerprint.Metadata
+	return fut, nil
+}
+
+// ResumeSearch reconstructs a future encoded by PexSearchFuture.MarshalJSON,
+// which allows to retrieve the result of a search started by another client,
+// e.g. before the process was restarted. The search must have been started
+// with the same credentials.
+func (x *PexSearchClient) ResumeSearch(data []byte) (*PexSearchFuture, error) {
+	p, err := unmarshalFuture(data, searchKindPex)
+	if err != nil {
+		return nil, err
+	}
+
+	fut := newPexSearchFuture(x, p.LookupIDs, x.opts.pollPolicy)
+	fut.Type = p.SearchType
+	fut.StartedAt = p.StartedAt
+	fut.FingerprintMetadata = p.Fingerprint.metadata()
+	return fut, nil
 }
 
+// CheckSearch blocks until the result of the search identified by the
+// lookup IDs is ready and then returns it.
 func (x *PexSearchClient) CheckSearch(lookupIDs []string) (*PexSearchResult, error) {
-	C.Pex_Lock()
+	return x.CheckSearchContext(context.Background(), lookupIDs)
+}
+
+// CheckSearchContext is like CheckSearch but returns ctx.Err() as soon
+// as the context is done.
+func (x *PexSearchClient) CheckSearchContext(ctx context.Context, lookupIDs []string) (*PexSearchResult, error) {
+	if err := validateLookupIDs(lookupIDs); err != nil {
+		return nil, err
+	}
+
+	return call(ctx, x.client, "CheckSearch", true, func(ctx context.Context, c *C.Pex_Client) (*PexSearchResult, error) {
+		return x.checkSearch(ctx, c, lookupIDs)
+	})
+}
+
+func (x *PexSearchClient) checkSearch(ctx context.Context, c *C.Pex_Client, lookupIDs []string) (*PexSearchResult, error) {
+	if err := lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer C.Pex_Unlock()
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cStatus, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
-	cRequest := C.Pex_CheckSearchRequest_New()
-	if cRequest == nil {
-		panic("out of memory")
+	cRequest, err := a.checkSearchRequest()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_CheckSearchRequest_Delete(&cRequest)
 
-	cResult := C.Pex_CheckSearchResult_New()
-	if cResult == nil {
-		panic("out of memory")
+	cResult, err := a.checkSearchResult()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_CheckSearchResult_Delete(&cResult)
 
 	for _, lookupID := range lookupIDs {
 		cLookupID := C.CString(lookupID)
@@ -235,7 +414,7 @@ func (x *PexSearchClient) CheckSearch(lookupIDs []string) (*PexSearchResult, err
 		C.Pex_CheckSearchRequest_AddLookupID(cRequest, cLookupID)
 	}
 
-	C.Pex_CheckSearch(x.c, cRequest, cResult, cStatus)
+	C.Pex_CheckSearch(c, cRequest, cResult, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
@@ -9,8 +9,10 @@ package pex
 // #include <stdlib.h>
 import "C"
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 	"unsafe"
 )
 
@@ -37,6 +39,10 @@ type PrivateSearchResult struct {
 
 	// The content classification of the query file, e.g. "music", "silence", "speech".
 	ContentClassification ContentClassification `json:"content_classification"`
+
+	// The fingerprint of the query, only set by SearchFile and SearchBuffer
+	// when SearchOptions.ReturnFingerprint is true.
+	Fingerprint *Fingerprint `json:"-"`
 }
 
 // PrivateSearchMatch contains detailed information about the match,
@@ -46,6 +52,10 @@ type PrivateSearchMatch struct {
 	// The ID provided during ingestion.
 	ProvidedID string `json:"provided_id"`
 
+	// The name of the catalog the match was found in. It's only set by
+	// CatalogRegistry, because a client always searches a single catalog.
+	Catalog string `json:"catalog,omitempty"`
+
 	// The matching time segments on the query and asset respectively.
 	MatchDetails *MatchDetails `json:"match_details"`
 }
@@ -53,16 +63,86 @@ type PrivateSearchMatch struct {
 // PrivateSearchFuture object is returned by the Client.StartPrivateSearch
 // function and is used to retrieve a search result.
 type PrivateSearchFuture struct {
-	client *PrivateSearchClient
+	f *future[*PrivateSearchResult]
 
 	LookupIDs []string
+
+	// StartedAt is the time the search was started.
+	StartedAt time.Time
+
+	// FingerprintMetadata is the metadata of the searched fingerprint. Its
+	// Offset is needed to call ShiftQuery on the result of a range search.
+	FingerprintMetadata FingerprintMetadata
+}
+
+// NewPrivateSearchFuture creates a future that retrieves the result of the
+// search identified by the lookup IDs using the given searcher. Only the
+// WithPollPolicy option applies to the future.
+func NewPrivateSearchFuture(searcher PrivateSearcher, lookupIDs []string, opts ...Option) *PrivateSearchFuture {
+	return newPrivateSearchFuture(searcher, lookupIDs, newOptions(opts).pollPolicy)
+}
+
+func newPrivateSearchFuture(searcher PrivateSearcher, lookupIDs []string, policy PollPolicy) *PrivateSearchFuture {
+	return &PrivateSearchFuture{
+		f: newFuture(func(ctx context.Context) (*PrivateSearchResult, error) {
+			return searcher.CheckSearchContext(ctx, lookupIDs)
+		}, policy),
+		LookupIDs: lookupIDs,
+	}
 }
 
-// Get blocks until the search result is ready and then returns it. It
-// also releases all the allocated resources, so it will return an
-// error when called multiple times.
+// Get blocks until the search result is ready and then returns it. The
+// outcome is retrieved only once, so calling Get again returns the same
+// result or error right away.
 func (x *PrivateSearchFuture) Get() (*PrivateSearchResult, error) {
-	return x.client.CheckSearch(x.LookupIDs)
+	return x.GetContext(context.Background())
+}
+
+// GetContext is like Get but returns ctx.Err() as soon as the context
+// is done. The polling continues in the background.
+func (x *PrivateSearchFuture) GetContext(ctx context.Context) (*PrivateSearchResult, error) {
+	return x.f.GetContext(ctx)
+}
+
+// Done returns a channel that's closed when the outcome of the search is
+// known. It starts polling for the result in the background.
+func (x *PrivateSearchFuture) Done() <-chan struct{} {
+	return x.f.Done()
+}
+
+// Wait blocks until the outcome of the search is known and returns the
+// error of the search, if any. It returns ctx.Err() as soon as the context
+// is done.
+func (x *PrivateSearchFuture) Wait(ctx context.Context) error {
+	return x.f.Wait(ctx)
+}
+
+// TryGet returns the result without blocking. The returned bool is false if
+// the outcome of the search is not known yet. It starts polling for the
+// result in the background.
+func (x *PrivateSearchFuture) TryGet() (*PrivateSearchResult, bool, error) {
+	return x.f.TryGet()
+}
+
+// Cancel stops polling for the result, after which Get returns
+// context.Canceled, unless the outcome was already known. The search
+// itself is not canceled on the backend.
+func (x *PrivateSearchFuture) Cancel() {
+	x.f.Cancel()
+}
+
+// MarshalJSON encodes the future, so that the search can be resumed later,
+// possibly by another process, using PrivateSearchClient.ResumeSearch. The
+// result is not part of the encoded future. There's no UnmarshalJSON,
+// since the future needs a client to poll for the result: decode it using
+// ResumeSearch. A future decoded otherwise fails right away.
+func (x *PrivateSearchFuture) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&persistedFuture{
+		Kind:        searchKindPrivate,
+		LookupIDs:   x.LookupIDs,
+		StartedAt:   x.StartedAt,
+		Fingerprint: newFingerprintFileMetadata(x.FingerprintMetadata),
+	})
 }
 
 // PrivateSearchClient serves as an entry point to all operations that
@@ -71,75 +151,113 @@ func (x *PrivateSearchFuture) Get() (*PrivateSearchResult, error) {
 // service.
 type PrivateSearchClient struct {
 	fingerprinter
+}
 
-	c *C.Pex_Client
+// NewPrivateSearchClient initializes a new client and authenticates it
+// using the given credentials. The options are applied to every
+// operation performed by the client.
+func NewPrivateSearchClient(clientID, clientSecret string, opts ...Option) (*PrivateSearchClient, error) {
+	return NewPrivateSearchClientWithCredentials(context.Background(), StaticCredentials(clientID, clientSecret), opts...)
 }
 
-func NewPrivateSearchClient(clientID, clientSecret string) (*PrivateSearchClient, error) {
-	cClient, err := newClient(C.Pex_PRIVATE_SEARCH, clientID, clientSecret)
+// NewPrivateSearchClientWithCredentials is like NewPrivateSearchClient, but
+// retrieves the credentials from the given provider. The provider is
+// consulted again whenever the backend rejects the current credentials,
+// or when RefreshCredentials is called, so that rotated credentials are
+// picked up without re-creating the client.
+func NewPrivateSearchClientWithCredentials(ctx context.Context, provider CredentialsProvider, opts ...Option) (*PrivateSearchClient, error) {
+	c, err := newClient(ctx, C.Pex_PRIVATE_SEARCH, provider, opts)
 	if err != nil {
 		return nil, err
 	}
 	return &PrivateSearchClient{
 		fingerprinter: fingerprinter{
-			c: cClient,
+			client: c,
 		},
-		c: cClient,
 	}, nil
 }
 
 // Close closes all connections to the backend service and releases
-// the memory manually allocated by the core library.
+// the memory manually allocated by the core library. The core library
+// itself is only cleaned up once all the clients are closed. Close
+// waits for all the in-flight operations to finish. It's safe to call
+// it multiple times, even concurrently, and every call returns only
+// after the client is fully closed. All the operations performed on the
+// client after it was closed return ErrClientClosed.
 func (x *PrivateSearchClient) Close() error {
-	return closeClient(&x.c)
+	return x.close()
+}
+
+// RefreshCredentials retrieves the credentials from the provider and, if
+// they changed, re-initializes the client with them. The operations started
+// afterwards use the new credentials right away, RefreshCredentials then
+// waits for the operations that were already in flight to finish, so that
+// the old credentials can be released. If the context is done first, it
+// returns ctx.Err() and the old credentials are released in the
+// background.
+func (x *PrivateSearchClient) RefreshCredentials(ctx context.Context) error {
+	_, err := x.refresh(ctx)
+	return err
 }
 
 func (x *PrivateSearchClient) getCClient() *C.Pex_Client {
-	return x.c
+	return x.native()
 }
 
 // StartSearch starts a private search. This operation does not block until
 // the search is finished, it does however perform a network operation
 // to initiate the search on the backend service.
 func (x *PrivateSearchClient) StartSearch(req *PrivateSearchRequest) (*PrivateSearchFuture, error) {
-	C.Pex_Lock()
-	defer C.Pex_Unlock()
+	return x.StartSearchContext(context.Background(), req)
+}
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+// StartSearchContext is like StartSearch but returns ctx.Err() as soon
+// as the context is done.
+func (x *PrivateSearchClient) StartSearchContext(ctx context.Context, req *PrivateSearchRequest) (*PrivateSearchFuture, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
-	cRequest := C.Pex_StartSearchRequest_New()
-	if cRequest == nil {
-		panic("out of memory")
+	return call(ctx, x.client, "StartSearch", false, func(ctx context.Context, c *C.Pex_Client) (*PrivateSearchFuture, error) {
+		return x.startSearch(ctx, c, req)
+	})
+}
+
+func (x *PrivateSearchClient) startSearch(ctx context.Context, c *C.Pex_Client, req *PrivateSearchRequest) (*PrivateSearchFuture, error) {
+	if err := lockContext(ctx); err != nil {
+		return nil, err
 	}
-	defer C.Pex_StartSearchRequest_Delete(&cRequest)
+	defer C.Pex_Unlock()
+
+	var a allocator
+	defer a.free()
 
-	cResult := C.Pex_StartSearchResult_New()
-	if cResult == nil {
-		panic("out of memory")
+	cStatus, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_StartSearchResult_Delete(&cResult)
 
-	cBuffer := C.Pex_Buffer_New()
-	if cBuffer == nil {
-		panic("out of memory")
+	cRequest, err := a.startSearchRequest()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Buffer_Delete(&cBuffer)
 
-	ftData := unsafe.Pointer(&req.Fingerprint.b[0])
-	ftSize := C.size_t(len(req.Fingerprint.b))
+	cResult, err := a.startSearchResult()
+	if err != nil {
+		return nil, err
+	}
 
-	C.Pex_Buffer_Set(cBuffer, ftData, ftSize)
+	cBuffer, err := a.bufferFrom(req.Fingerprint.b)
+	if err != nil {
+		return nil, err
+	}
 
 	C.Pex_StartSearchRequest_SetFingerprint(cRequest, cBuffer, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
 
-	C.Pex_StartSearch(x.c, cRequest, cResult, cStatus)
+	C.Pex_StartSearch(c, cRequest, cResult, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
@@ -152,33 +270,69 @@ func (x *PrivateSearchClient) StartSearch(req *PrivateSearchRequest) (*PrivateSe
 		lookupIDs = append(lookupIDs, C.GoString(cLookupID))
 	}
 
-	return &PrivateSearchFuture{
-		client:    x,
-		LookupIDs: lookupIDs,
-	}, nil
+	fut := newPrivateSearchFuture(x, lookupIDs, x.opts.pollPolicy)
+	fut.StartedAt = time.Now().UTC()
+	fut.FingerprintMetadata = req.Fingerprint.Metadata
+	return fut, nil
+}
+
+// ResumeSearch reconstructs a future encoded by
+// PrivateSearchFuture.MarshalJSON, which allows to retrieve the result of a
+// search started by another client, e.g. before the process was restarted.
+// The search must have been started with the same credentials.
+func (x *PrivateSearchClient) ResumeSearch(data []byte) (*PrivateSearchFuture, error) {
+	p, err := unmarshalFuture(data, searchKindPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	fut := newPrivateSearchFuture(x, p.LookupIDs, x.opts.pollPolicy)
+	fut.StartedAt = p.StartedAt
+	fut.FingerprintMetadata = p.Fingerprint.metadata()
+	return fut, nil
 }
 
+// CheckSearch blocks until the result of the search identified by the
+// lookup IDs is ready and then returns it.
 func (x *PrivateSearchClient) CheckSearch(lookupIDs []string) (*PrivateSearchResult, error) {
-	C.Pex_Lock()
+	return x.CheckSearchContext(context.Background(), lookupIDs)
+}
+
+// CheckSearchContext is like CheckSearch but returns ctx.Err() as soon
+// as the context is done.
+func (x *PrivateSearchClient) CheckSearchContext(ctx context.Context, lookupIDs []string) (*PrivateSearchResult, error) {
+	if err := validateLookupIDs(lookupIDs); err != nil {
+		return nil, err
+	}
+
+	return call(ctx, x.client, "CheckSearch", true, func(ctx context.Context, c *C.Pex_Client) (*PrivateSearchResult, error) {
+		return x.checkSearch(ctx, c, lookupIDs)
+	})
+}
+
+func (x *PrivateSearchClient) checkSearch(ctx context.Context, c *C.Pex_Client, lookupIDs []string) (*PrivateSearchResult, error) {
+	if err := lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer C.Pex_Unlock()
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cStatus, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
-	cRequest := C.Pex_CheckSearchRequest_New()
-	if cRequest == nil {
-		panic("out of memory")
+	cRequest, err := a.checkSearchRequest()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_CheckSearchRequest_Delete(&cRequest)
 
-	cResult := C.Pex_CheckSearchResult_New()
-	if cResult == nil {
-		panic("out of memory")
+	cResult, err := a.checkSearchResult()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_CheckSearchResult_Delete(&cResult)
 
 	for _, lookupID := range lookupIDs {
 		cLookupID := C.CString(lookupID)
@@ -186,7 +340,7 @@ func (x *PrivateSearchClient) CheckSearch(lookupIDs []string) (*PrivateSearchRes
 		C.Pex_CheckSearchRequest_AddLookupID(cRequest, cLookupID)
 	}
 
-	C.Pex_CheckSearch(x.c, cRequest, cResult, cStatus)
+	C.Pex_CheckSearch(c, cRequest, cResult, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
@@ -209,34 +363,54 @@ func (x *PrivateSearchClient) processResult(cResult *C.Pex_CheckSearchResult, lo
 // Ingest ingests a fingerprint into the private search
 // catalog. The catalog is determined from the authentication credentials used
 // when initializing the client. If you want to ingest into multiple catalogs
-// within one application, you need to use multiple clients. The id parameter
+// within one application, you need to use multiple clients, which can be
+// managed using CatalogRegistry. The id parameter
 // identifies the fingerprint and will be returned during search to identify
 // the matched asset.
 func (x *PrivateSearchClient) Ingest(id string, ft *Fingerprint) error {
-	C.Pex_Lock()
+	return x.IngestContext(context.Background(), id, ft)
+}
+
+// IngestContext is like Ingest but returns ctx.Err() as soon as the
+// context is done. Keep in mind that the fingerprint might still get
+// ingested in that case.
+func (x *PrivateSearchClient) IngestContext(ctx context.Context, id string, ft *Fingerprint) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := validateFingerprint(ft); err != nil {
+		return err
+	}
+
+	_, err := call(ctx, x.client, "Ingest", true, func(ctx context.Context, c *C.Pex_Client) (struct{}, error) {
+		return struct{}{}, x.ingest(ctx, c, id, ft)
+	})
+	return err
+}
+
+func (x *PrivateSearchClient) ingest(ctx context.Context, c *C.Pex_Client, id string, ft *Fingerprint) error {
+	if err := lockContext(ctx); err != nil {
+		return err
+	}
 	defer C.Pex_Unlock()
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cStatus, err := a.status()
+	if err != nil {
+		return err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
 	cID := C.CString(id)
 	defer C.free(unsafe.Pointer(cID))
 
-	cBuffer := C.Pex_Buffer_New()
-	if cBuffer == nil {
-		panic("out of memory")
+	cBuffer, err := a.bufferFrom(ft.b)
+	if err != nil {
+		return err
 	}
-	defer C.Pex_Buffer_Delete(&cBuffer)
 
-	ftData := unsafe.Pointer(&ft.b[0])
-	ftSize := C.size_t(len(ft.b))
-
-	C.Pex_Buffer_Set(cBuffer, ftData, ftSize)
-
-	C.Pex_Ingest(x.c, cID, cBuffer, cStatus)
+	C.Pex_Ingest(c, cID, cBuffer, cStatus)
 	return statusToError(cStatus)
 }
 
@@ -244,19 +418,44 @@ func (x *PrivateSearchClient) Ingest(id string, ft *Fingerprint) error {
 // catalog. The catalog is determined from the authentication credentials used
 // when initializing the client.
 func (x *PrivateSearchClient) Archive(id string, types ...FingerprintType) error {
-	C.Pex_Lock()
+	return x.ArchiveContext(context.Background(), id, types...)
+}
+
+// ArchiveContext is like Archive but returns ctx.Err() as soon as the
+// context is done. Keep in mind that the fingerprint might still get
+// archived in that case.
+func (x *PrivateSearchClient) ArchiveContext(ctx context.Context, id string, types ...FingerprintType) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := validateTypes(types); err != nil {
+		return err
+	}
+
+	_, err := call(ctx, x.client, "Archive", true, func(ctx context.Context, c *C.Pex_Client) (struct{}, error) {
+		return struct{}{}, x.archive(ctx, c, id, types)
+	})
+	return err
+}
+
+func (x *PrivateSearchClient) archive(ctx context.Context, c *C.Pex_Client, id string, types []FingerprintType) error {
+	if err := lockContext(ctx); err != nil {
+		return err
+	}
 	defer C.Pex_Unlock()
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cStatus, err := a.status()
+	if err != nil {
+		return err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
 	cID := C.CString(id)
 	defer C.free(unsafe.Pointer(cID))
 
-	C.Pex_Archive(x.c, cID, C.int(reduceTypes(types)), cStatus)
+	C.Pex_Archive(c, cID, C.int(reduceTypes(types)), cStatus)
 	return statusToError(cStatus)
 }
 
@@ -281,7 +480,9 @@ type ListEntriesRequest struct {
 	After string
 }
 
-type listEntriesResult struct {
+// ListEntriesPage is a single page of entries returned by
+// PrivateSearchClient.ListEntriesPage.
+type ListEntriesPage struct {
 	Entries     []Entry `json:"entries"`
 	EndCursor   string  `json:"end_cursor"`
 	HasNextPage bool    `json:"has_next_page"`
@@ -292,7 +493,7 @@ type listEntriesResult struct {
 // to retrieve the entries in smaller chunks, which is important if the catalog
 // contains too many entries.
 type Lister struct {
-	c *C.Pex_Client
+	pager EntryPager
 
 	Limit       int
 	EndCursor   string
@@ -301,56 +502,99 @@ type Lister struct {
 
 // List grabs the next "page" and returns entries.
 func (x *Lister) List() ([]Entry, error) {
-	C.Pex_Lock()
+	return x.ListContext(context.Background())
+}
+
+// ListContext is like List but returns ctx.Err() as soon as the context
+// is done. The Lister is only advanced to the next page when the
+// entries are successfully returned.
+func (x *Lister) ListContext(ctx context.Context) ([]Entry, error) {
+	res, err := x.pager.ListEntriesPage(ctx, &ListEntriesRequest{
+		Limit: x.Limit,
+		After: x.EndCursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	x.EndCursor = res.EndCursor
+	x.HasNextPage = res.HasNextPage
+
+	return res.Entries, nil
+}
+
+// ListEntriesPage retrieves a single page of entries starting after the
+// cursor specified in the request. Most users will find it more convenient
+// to use ListEntries instead.
+func (x *PrivateSearchClient) ListEntriesPage(ctx context.Context, req *ListEntriesRequest) (*ListEntriesPage, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	return call(ctx, x.client, "List", true, func(ctx context.Context, c *C.Pex_Client) (*ListEntriesPage, error) {
+		return x.listEntriesPage(ctx, c, req.Limit, req.After)
+	})
+}
+
+func (x *PrivateSearchClient) listEntriesPage(ctx context.Context, c *C.Pex_Client, limit int, after string) (*ListEntriesPage, error) {
+	if err := lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer C.Pex_Unlock()
 
-	cReq := C.Pex_ListRequest_New()
-	if cReq == nil {
-		panic("out of memory")
+	var a allocator
+	defer a.free()
+
+	cReq, err := a.listRequest()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_ListRequest_Delete(&cReq)
 
-	cRes := C.Pex_ListResult_New()
-	if cRes == nil {
-		panic("out of memory")
+	cRes, err := a.listResult()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_ListResult_Delete(&cRes)
 
-	cStatus := C.Pex_Status_New()
-	if cStatus == nil {
-		panic("out of memory")
+	cStatus, err := a.status()
+	if err != nil {
+		return nil, err
 	}
-	defer C.Pex_Status_Delete(&cStatus)
 
-	cAfter := C.CString(x.EndCursor)
+	cAfter := C.CString(after)
 	defer C.free(unsafe.Pointer(cAfter))
 
-	C.Pex_ListRequest_SetLimit(cReq, C.int(x.Limit))
+	C.Pex_ListRequest_SetLimit(cReq, C.int(limit))
 	C.Pex_ListRequest_SetAfter(cReq, cAfter)
 
-	C.Pex_List(x.c, cReq, cRes, cStatus)
+	C.Pex_List(c, cReq, cRes, cStatus)
 	if err := statusToError(cStatus); err != nil {
 		return nil, err
 	}
 
 	j := C.GoString(C.Pex_ListResult_GetJSON(cRes))
 
-	var res listEntriesResult
-	if err := json.Unmarshal([]byte(j), &res); err != nil {
+	res := new(ListEntriesPage)
+	if err := json.Unmarshal([]byte(j), res); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal json: %w", err)
 	}
-
-	x.EndCursor = res.EndCursor
-	x.HasNextPage = res.HasNextPage
-
-	return res.Entries, nil
+	return res, nil
 }
 
 // ListEntries initiates listing of the catalog and returns a Lister that can
 // be used to retrieve the entries.
 func (x *PrivateSearchClient) ListEntries(req *ListEntriesRequest) *Lister {
+	return NewLister(x, req)
+}
+
+// NewLister creates a Lister that retrieves the pages using the given
+// pager. A nil request lists the catalog from the beginning using the
+// default limit.
+func NewLister(pager EntryPager, req *ListEntriesRequest) *Lister {
+	if req == nil {
+		req = new(ListEntriesRequest)
+	}
 	return &Lister{
-		c:           x.c,
+		pager:       pager,
 		Limit:       req.Limit,
 		EndCursor:   req.After,
 		HasNextPage: true,
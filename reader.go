@@ -0,0 +1,124 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultReaderMemoryLimit is the maximum size of the media that
+// FingerprintReader keeps in memory, unless overridden using
+// WithReaderMemoryLimit. Larger media is spooled to a temporary file.
+const DefaultReaderMemoryLimit = 64 << 20
+
+// WithReaderMemoryLimit sets the maximum size of the media that
+// FingerprintReader keeps in memory. Larger media is spooled to a temporary
+// file created in the default directory for temporary files.
+func WithReaderMemoryLimit(limit int64) Option {
+	return func(o *options) {
+		o.readerMemoryLimit = limit
+	}
+}
+
+// FingerprintReader is used to generate a fingerprint from media
+// read from r, e.g. from an upload stream or from an object storage. The
+// size parameter is the number of bytes to read, or -1 if unknown, in
+// which case r is read until EOF. Media that fits into the memory limit
+// (see WithReaderMemoryLimit) is fingerprinted from memory, larger media is
+// spooled to a temporary file, which is removed afterwards. The types
+// parameter specifies which types of fingerprints to create. If no types
+// are provided, FingerprintTypeAll is assumed.
+func (x *fingerprinter) FingerprintReader(r io.Reader, size int64, types ...FingerprintType) (*Fingerprint, error) {
+	return x.FingerprintReaderContext(context.Background(), r, size, types...)
+}
+
+// FingerprintReaderContext is like FingerprintReader but stops reading and
+// returns ctx.Err() as soon as the context is done.
+func (x *fingerprinter) FingerprintReaderContext(ctx context.Context, r io.Reader, size int64, types ...FingerprintType) (*Fingerprint, error) {
+	return fingerprintReader(ctx, x, x.opts.readerMemoryLimit, r, size, types)
+}
+
+// fingerprintReader implements FingerprintReaderContext on top of any
+// Fingerprinter.
+func fingerprintReader(ctx context.Context, fp Fingerprinter, limit int64, r io.Reader, size int64, types []FingerprintType) (*Fingerprint, error) {
+	if r == nil {
+		return nil, errInvalidInput("reader must not be nil")
+	}
+	if err := validateTypes(types); err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		limit = DefaultReaderMemoryLimit
+	}
+
+	r = &contextReader{ctx: ctx, r: r}
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+
+	var head []byte
+	if size < 0 || size <= limit {
+		// Read one more byte than the limit to find out whether the
+		// media fits into memory.
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(io.LimitReader(r, limit+1)); err != nil {
+			return nil, fmt.Errorf("failed to read media: %w", err)
+		}
+		head = buf.Bytes()
+
+		if int64(len(head)) <= limit {
+			if size >= 0 && int64(len(head)) != size {
+				return nil, fmt.Errorf("failed to read media: %w", io.ErrUnexpectedEOF)
+			}
+			return fp.FingerprintBufferContext(ctx, head, types...)
+		}
+	}
+
+	path, err := spool(head, r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	return fp.FingerprintFileContext(ctx, path, types...)
+}
+
+// spool writes head followed by the rest of r into a temporary file and
+// returns its path. The caller is responsible for removing the file.
+func spool(head []byte, r io.Reader, size int64) (string, error) {
+	f, err := os.CreateTemp("", "pex-media-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), r))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to spool media: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// contextReader stops reading once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (x *contextReader) Read(p []byte) (int, error) {
+	if err := x.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return x.r.Read(p)
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// recordingFingerprinter records how the media was passed to it. Only the
+// methods used by fingerprintReader are implemented.
+type recordingFingerprinter struct {
+	Fingerprinter
+
+	path string // the path of the last fingerprinted file
+	data []byte // the last fingerprinted media
+}
+
+func (x *recordingFingerprinter) FingerprintBufferContext(ctx context.Context, buffer []byte, types ...FingerprintType) (*Fingerprint, error) {
+	x.path, x.data = "", buffer
+	return newTestFingerprint(4), nil
+}
+
+func (x *recordingFingerprinter) FingerprintFileContext(ctx context.Context, path string, types ...FingerprintType) (*Fingerprint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	x.path, x.data = path, data
+	return newTestFingerprint(4), nil
+}
+
+func TestFingerprintReader(t *testing.T) {
+	const limit = 8
+
+	tests := []struct {
+		name     string
+		media    string
+		size     int64
+		wantFile bool
+	}{
+		{"empty unknown size", "", -1, false},
+		{"small unknown size", "abc", -1, false},
+		{"limit unknown size", "abcdefgh", -1, false},
+		{"large unknown size", "abcdefghi", -1, true},
+		{"small known size", "abc", 3, false},
+		{"limit known size", "abcdefgh", 8, false},
+		{"large known size", "abcdefghijklmnop", 16, true},
+		{"shorter size", "abcdefghijklmnop", 4, false},
+		{"shorter large size", "abcdefghijklmnop", 12, true},
+	}
+	for _, tt := range tests {
+		fp := new(recordingFingerprinter)
+		_, err := fingerprintReader(context.Background(), fp, limit, strings.NewReader(tt.media), tt.size, nil)
+		if err != nil {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+
+		want := tt.media
+		if tt.size >= 0 {
+			want = want[:tt.size]
+		}
+		if string(fp.data) != want {
+			t.Errorf("%s: fingerprinted %q, want %q", tt.name, fp.data, want)
+		}
+		if got := fp.path != ""; got != tt.wantFile {
+			t.Errorf("%s: fingerprinted a file: %v, want %v", tt.name, got, tt.wantFile)
+		}
+		if fp.path != "" {
+			if _, err := os.Stat(fp.path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s: temporary file not removed: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+// checkNoTempFiles checks that no temporary files are left in dir.
+func checkNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("temporary file %s not removed", e.Name())
+	}
+}
+
+func TestFingerprintReaderSizeMismatch(t *testing.T) {
+	const limit = 8
+
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	// The media is shorter than the size, both when it fits into memory
+	// and when it's spooled.
+	for _, size := range []int64{4, 16} {
+		fp := new(recordingFingerprinter)
+		_, err := fingerprintReader(context.Background(), fp, limit, strings.NewReader("abc"), size, nil)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("size %d: got error %v, want %v", size, err, io.ErrUnexpectedEOF)
+		}
+		if fp.data != nil {
+			t.Errorf("size %d: fingerprinted incomplete media", size)
+		}
+	}
+	checkNoTempFiles(t, dir)
+}
+
+func TestFingerprintReaderInvalidInput(t *testing.T) {
+	fp := new(recordingFingerprinter)
+	if _, err := fingerprintReader(context.Background(), fp, 8, nil, -1, nil); err == nil {
+		t.Error("nil reader: got no error")
+	}
+	if _, err := fingerprintReader(context.Background(), fp, 8, strings.NewReader("abc"), -1, []FingerprintType{0}); err == nil {
+		t.Error("invalid type: got no error")
+	}
+}
+
+// cancelingReader cancels the context once it has returned n bytes.
+type cancelingReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (x *cancelingReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	n, err := x.r.Read(p)
+	if x.n -= n; x.n <= 0 {
+		x.cancel()
+	}
+	return n, err
+}
+
+func TestFingerprintReaderCancel(t *testing.T) {
+	const limit = 8
+
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	// The context is canceled both while the media is read into memory
+	// and while it's spooled.
+	for _, after := range []int{4, 12} {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &cancelingReader{r: bytes.NewReader(make([]byte, 32)), n: after, cancel: cancel}
+
+		fp := new(recordingFingerprinter)
+		_, err := fingerprintReader(ctx, fp, limit, r, -1, nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("canceled after %d bytes: got error %v, want %v", after, err, context.Canceled)
+		}
+		if fp.data != nil {
+			t.Errorf("canceled after %d bytes: fingerprinted the media", after)
+		}
+		if r.n < 0 {
+			t.Errorf("canceled after %d bytes: read %d more bytes", after, -r.n)
+		}
+		cancel()
+	}
+	checkNoTempFiles(t, dir)
+}
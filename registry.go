@@ -0,0 +1,301 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CatalogRegistry manages private search clients for multiple catalogs
+// within one application. Every catalog is identified by a logical name and
+// has its own credentials. The clients are created lazily, when the catalog
+// is used for the first time, and are shared by all the callers.
+type CatalogRegistry struct {
+	opts []Option
+
+	mu       sync.Mutex
+	closed   bool
+	catalogs map[string]*registryEntry
+}
+
+type registryEntry struct {
+	provider CredentialsProvider
+
+	mu     sync.Mutex
+	client *PrivateSearchClient
+}
+
+// NewCatalogRegistry creates an empty registry. The options are applied to
+// all the clients created by the registry.
+func NewCatalogRegistry(opts ...Option) *CatalogRegistry {
+	return &CatalogRegistry{
+		opts:     opts,
+		catalogs: make(map[string]*registryEntry),
+	}
+}
+
+// Register adds a catalog to the registry. The client for the catalog is
+// not created until the catalog is used.
+func (x *CatalogRegistry) Register(name string, provider CredentialsProvider) error {
+	if provider == nil {
+		return errInvalidInput("credentials provider of catalog %q must not be nil", name)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.closed {
+		return ErrClientClosed
+	}
+	if _, ok := x.catalogs[name]; ok {
+		return fmt.Errorf("catalog %q is already registered", name)
+	}
+	x.catalogs[name] = &registryEntry{
+		provider: provider,
+	}
+	return nil
+}
+
+// Catalogs returns the sorted names of all the registered catalogs.
+func (x *CatalogRegistry) Catalogs() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	names := make([]string, 0, len(x.catalogs))
+	for name := range x.catalogs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Client returns the client for the given catalog, creating it if
+// necessary.
+func (x *CatalogRegistry) Client(ctx context.Context, name string) (*PrivateSearchClient, error) {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	entry, ok := x.catalogs[name]
+	x.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("catalog %q is not registered", name)
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.client != nil {
+		return entry.client, nil
+	}
+
+	client, err := NewPrivateSearchClientWithCredentials(ctx, entry.provider, x.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for catalog %q: %w", name, err)
+	}
+
+	// The registry might have been closed while the client was created.
+	x.mu.Lock()
+	closed := x.closed
+	x.mu.Unlock()
+	if closed {
+		client.Close()
+		return nil, ErrClientClosed
+	}
+
+	entry.client = client
+	return client, nil
+}
+
+// Ingest ingests a fingerprint into the given catalog. See
+// PrivateSearchClient.Ingest for details.
+func (x *CatalogRegistry) Ingest(ctx context.Context, catalog, id string, ft *Fingerprint) error {
+	client, err := x.Client(ctx, catalog)
+	if err != nil {
+		return err
+	}
+	return client.IngestContext(ctx, id, ft)
+}
+
+// Archive archives a fingerprint in the given catalog. See
+// PrivateSearchClient.Archive for details.
+func (x *CatalogRegistry) Archive(ctx context.Context, catalog, id string, types ...FingerprintType) error {
+	client, err := x.Client(ctx, catalog)
+	if err != nil {
+		return err
+	}
+	return client.ArchiveContext(ctx, id, types...)
+}
+
+// ListEntries returns a Lister for the given catalog. See
+// PrivateSearchClient.ListEntries for details.
+func (x *CatalogRegistry) ListEntries(ctx context.Context, catalog string, req *ListEntriesRequest) (*Lister, error) {
+	client, err := x.Client(ctx, catalog)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListEntries(req), nil
+}
+
+// Search performs a private search in the given catalog and waits for the
+// result. The Catalog field of all the returned matches is set to the name
+// of the catalog.
+func (x *CatalogRegistry) Search(ctx context.Context, catalog string, req *PrivateSearchRequest) (*PrivateSearchResult, error) {
+	client, err := x.Client(ctx, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	fut, err := client.StartSearchContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fut.Cancel()
+	res, err := fut.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range res.Matches {
+		m.Catalog = catalog
+	}
+	return res, nil
+}
+
+// SearchCatalogsConcurrency is the maximum number of catalogs SearchCatalogs
+// searches at the same time.
+const SearchCatalogsConcurrency = 8
+
+// CatalogSearchError is returned by SearchCatalogs when the search failed
+// in some of the catalogs.
+type CatalogSearchError struct {
+	// Errors maps the names of the failed catalogs to their errors.
+	Errors map[string]error
+}
+
+func (e *CatalogSearchError) Error() string {
+	names := e.names()
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %v", name, e.Errors[name])
+	}
+	return "search failed in some catalogs: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors of the failed catalogs sorted by their names, so
+// that errors.Is and errors.As can be used to inspect them.
+func (e *CatalogSearchError) Unwrap() []error {
+	names := e.names()
+	errs := make([]error, len(names))
+	for i, name := range names {
+		errs[i] = e.Errors[name]
+	}
+	return errs
+}
+
+func (e *CatalogSearchError) names() []string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SearchCatalogs performs the same private search in multiple catalogs
+// concurrently, at most SearchCatalogsConcurrency at a time, and merges the
+// results into one. If no catalogs are given, all the registered catalogs
+// are searched. The Catalog field of the matches identifies which catalog
+// they were found in.
+//
+// If the search fails in some of the catalogs, the merged result of the
+// others is returned together with a *CatalogSearchError.
+func (x *CatalogRegistry) SearchCatalogs(ctx context.Context, req *PrivateSearchRequest, catalogs ...string) (*PrivateSearchResult, error) {
+	if len(catalogs) == 0 {
+		catalogs = x.Catalogs()
+	}
+
+	return searchCatalogs(ctx, catalogs, func(ctx context.Context, name string) (*PrivateSearchResult, error) {
+		return x.Search(ctx, name, req)
+	})
+}
+
+func searchCatalogs(ctx context.Context, catalogs []string, search func(context.Context, string) (*PrivateSearchResult, error)) (*PrivateSearchResult, error) {
+	results := make([]*PrivateSearchResult, len(catalogs))
+	errs := make([]error, len(catalogs))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, SearchCatalogsConcurrency)
+	for i, name := range catalogs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = search(ctx, name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	merged := new(PrivateSearchResult)
+	failed := make(map[string]error)
+
+	first := true
+	for i, res := range results {
+		if errs[i] != nil {
+			failed[catalogs[i]] = errs[i]
+			continue
+		}
+		if first {
+			merged.QueryFileDurationSeconds = res.QueryFileDurationSeconds
+			merged.ContentClassification = res.ContentClassification
+			first = false
+		}
+		merged.LookupIDs = append(merged.LookupIDs, res.LookupIDs...)
+		merged.Matches = append(merged.Matches, res.Matches...)
+	}
+
+	if len(failed) > 0 {
+		return merged, &CatalogSearchError{Errors: failed}
+	}
+	return merged, nil
+}
+
+// Close closes all the clients created by the registry. All the
+// operations performed on the registry afterwards return ErrClientClosed.
+func (x *CatalogRegistry) Close() error {
+	x.mu.Lock()
+	if x.closed {
+		x.mu.Unlock()
+		return nil
+	}
+	x.closed = true
+	entries := x.catalogs
+	x.mu.Unlock()
+
+	var firstErr error
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if entry.client != nil {
+			if err := entry.client.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			entry.client = nil
+		}
+		entry.mu.Unlock()
+	}
+	return firstErr
+}
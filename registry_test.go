@@ -0,0 +1,107 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSearchCatalogs(t *testing.T) {
+	errB := errors.New("b failed")
+	errD := errors.New("d failed")
+
+	search := func(ctx context.Context, name string) (*PrivateSearchResult, error) {
+		switch name {
+		case "b":
+			return nil, errB
+		case "d":
+			return nil, errD
+		}
+		return &PrivateSearchResult{
+			LookupIDs:                []string{name},
+			Matches:                  []*PrivateSearchMatch{{ProvidedID: name, Catalog: name}},
+			QueryFileDurationSeconds: 10,
+		}, nil
+	}
+
+	res, err := searchCatalogs(context.Background(), []string{"a", "b", "c", "d"}, search)
+
+	var searchErr *CatalogSearchError
+	if !errors.As(err, &searchErr) {
+		t.Fatalf("got error %v, want a *CatalogSearchError", err)
+	}
+	if len(searchErr.Errors) != 2 || searchErr.Errors["b"] != errB || searchErr.Errors["d"] != errD {
+		t.Errorf("got errors %v, want the errors of b and d", searchErr.Errors)
+	}
+	if !errors.Is(err, errB) || !errors.Is(err, errD) {
+		t.Errorf("errors.Is(%v) doesn't find the errors of the catalogs", err)
+	}
+	if got, want := err.Error(), "search failed in some catalogs: b: b failed; d: d failed"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	// The results are merged in the order of the catalogs.
+	if got := fmt.Sprint(res.LookupIDs); got != "[a c]" {
+		t.Errorf("got lookup IDs %s, want [a c]", got)
+	}
+	if len(res.Matches) != 2 || res.Matches[0].Catalog != "a" || res.Matches[1].Catalog != "c" {
+		t.Errorf("got matches %v, want the matches of a and c", res.Matches)
+	}
+	if res.QueryFileDurationSeconds != 10 {
+		t.Errorf("got query duration %v, want 10", res.QueryFileDurationSeconds)
+	}
+
+	if _, err := searchCatalogs(context.Background(), []string{"a", "c"}, search); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestSearchCatalogsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var active, peak int
+	search := func(ctx context.Context, name string) (*PrivateSearchResult, error) {
+		mu.Lock()
+		if active++; active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return new(PrivateSearchResult), nil
+	}
+
+	catalogs := make([]string, 4*SearchCatalogsConcurrency)
+	for i := range catalogs {
+		catalogs[i] = fmt.Sprint(i)
+	}
+	if _, err := searchCatalogs(context.Background(), catalogs, search); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if peak > SearchCatalogsConcurrency {
+		t.Errorf("got %d concurrent searches, want at most %d", peak, SearchCatalogsConcurrency)
+	}
+}
+
+func TestSearchCatalogsCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	search := func(ctx context.Context, name string) (*PrivateSearchResult, error) {
+		return nil, ctx.Err()
+	}
+
+	_, err := searchCatalogs(ctx, []string{"a", "b"}, search)
+	var searchErr *CatalogSearchError
+	if !errors.As(err, &searchErr) || len(searchErr.Errors) != 2 || !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want both catalogs canceled", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+// #include <pex/sdk/init.h>
+// #include <stdlib.h>
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// ErrConflictingCredentials is returned when creating a client with a
+// client ID that is already used by another live client, but with a
+// different secret. The native library can't hold both at the same time,
+// so the other clients must be closed first.
+var ErrConflictingCredentials = errors.New("conflicting credentials")
+
+// nativeRuntime keeps track of all the live clients. The native library is
+// initialized when the first client is created and cleaned up when the last
+// one is closed, so that closing one client doesn't tear down the library
+// under the others.
+var nativeRuntime struct {
+	mu      sync.Mutex
+	refs    int
+	secrets map[string]*runtimeSecret
+}
+
+type runtimeSecret struct {
+	secret string
+	refs   int
+}
+
+// acquireRuntime initializes the native library if there are no live clients
+// yet and registers a new client using the given credentials. Every
+// successful call must be paired with a call to releaseRuntime.
+func acquireRuntime(clientID, clientSecret string) error {
+	rt := &nativeRuntime
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if s, ok := rt.secrets[clientID]; ok && s.secret != clientSecret {
+		return fmt.Errorf("%w: client %q is already initialized with a different secret", ErrConflictingCredentials, clientID)
+	}
+
+	if rt.refs == 0 {
+		if err := initRuntime(clientID, clientSecret); err != nil {
+			return err
+		}
+		rt.secrets = make(map[string]*runtimeSecret)
+	}
+
+	s, ok := rt.secrets[clientID]
+	if !ok {
+		s = &runtimeSecret{secret: clientSecret}
+		rt.secrets[clientID] = s
+	}
+	s.refs++
+	rt.refs++
+	return nil
+}
+
+// releaseRuntime unregisters a client previously registered by
+// acquireRuntime and cleans up the native library if it was the last one.
+func releaseRuntime(clientID string) {
+	rt := &nativeRuntime
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if s, ok := rt.secrets[clientID]; ok {
+		if s.refs--; s.refs == 0 {
+			delete(rt.secrets, clientID)
+		}
+	}
+
+	if rt.refs--; rt.refs == 0 {
+		C.Pex_Cleanup()
+	}
+}
+
+// switchRuntime moves a registered client from one set of credentials to
+// another one, e.g. when the credentials are rotated. The native library
+// stays initialized in the meantime.
+func switchRuntime(oldClientID, newClientID, newClientSecret string) error {
+	rt := &nativeRuntime
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	old, ok := rt.secrets[oldClientID]
+	if !ok {
+		return fmt.Errorf("client %q is not registered", oldClientID)
+	}
+
+	if s, ok := rt.secrets[newClientID]; ok && s.secret != newClientSecret {
+		// The secret can only be rotated if no other client uses the old one.
+		if s != old || s.refs > 1 {
+			return fmt.Errorf("%w: client %q is already initialized with a different secret", ErrConflictingCredentials, newClientID)
+		}
+		s.secret = newClientSecret
+		return nil
+	}
+
+	if old.refs--; old.refs == 0 {
+		delete(rt.secrets, oldClientID)
+	}
+
+	s, ok := rt.secrets[newClientID]
+	if !ok {
+		s = &runtimeSecret{secret: newClientSecret}
+		rt.secrets[newClientID] = s
+	}
+	s.refs++
+	return nil
+}
+
+func initRuntime(clientID, clientSecret string) error {
+	cClientID := C.CString(clientID)
+	defer C.free(unsafe.Pointer(cClientID))
+
+	cClientSecret := C.CString(clientSecret)
+	defer C.free(unsafe.Pointer(cClientSecret))
+
+	var cStatusCode C.int
+	cStatusMessage := make([]C.char, 100)
+	cStatusMessageSize := C.size_t(len(cStatusMessage))
+
+	C.Pex_Init(cClientID, cClientSecret, &cStatusCode, &cStatusMessage[0], cStatusMessageSize)
+	if StatusCode(cStatusCode) != StatusOK {
+		return &Error{
+			Code:    StatusCode(cStatusCode),
+			Message: C.GoString(&cStatusMessage[0]),
+		}
+	}
+	return nil
+}
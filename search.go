@@ -0,0 +1,159 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"time"
+)
+
+// SearchOptions configure SearchFile and SearchBuffer.
+type SearchOptions struct {
+	// Type is the type of the Pex search. When left unset, the type set
+	// using WithDefaultSearchType is used, see PexSearchRequest.Type. It's
+	// ignored by private search.
+	Type PexSearchType
+
+	// Types specifies which types of fingerprints to create. If empty, the
+	// types needed by the search are created: audio and melody fingerprints
+	// for IdentifyMusic, FingerprintTypeAll otherwise.
+	Types []FingerprintType
+
+	// Start and End limit the search to a time range of the media, see
+	// FingerprintOptions. The query segments and the content
+	// classification of the result are relative to the whole media.
+	Start time.Duration
+	End   time.Duration
+
+	// ReturnFingerprint makes SearchFile and SearchBuffer return the
+	// generated fingerprint in the Fingerprint field of the result, so that
+	// it can be reused, e.g. ingested or saved.
+	ReturnFingerprint bool
+}
+
+func (x *SearchOptions) fingerprintOptions(defaultTypes FingerprintType) FingerprintOptions {
+	opts := FingerprintOptions{
+		Types: x.Types,
+		Start: x.Start,
+		End:   x.End,
+	}
+	if len(opts.Types) == 0 {
+		opts.Types = []FingerprintType{defaultTypes}
+	}
+	return opts
+}
+
+// searchFingerprintTypes returns the fingerprint types needed by the given
+// type of Pex search.
+func searchFingerprintTypes(typ PexSearchType) FingerprintType {
+	if typ == IdentifyMusic {
+		return FingerprintTypeAudio | FingerprintTypeMelody
+	}
+	return FingerprintTypeAll
+}
+
+// SearchFile fingerprints the media file, performs a Pex search and waits
+// for the result. It does the same as calling FingerprintFileWithOptions,
+// StartSearch and Get one after another, so only retrieving the result is
+// retried according to the client's retry policy, like when calling Get;
+// neither the fingerprinting nor starting the search is retried. If opts is
+// nil, the defaults are used.
+func (x *PexSearchClient) SearchFile(ctx context.Context, path string, opts *SearchOptions) (*PexSearchResult, error) {
+	if opts == nil {
+		opts = new(SearchOptions)
+	}
+	typ := x.opts.resolveSearchType(opts.Type)
+
+	ft, err := x.FingerprintFileWithOptions(ctx, path, opts.fingerprintOptions(searchFingerprintTypes(typ)))
+	if err != nil {
+		return nil, err
+	}
+	return x.search(ctx, ft, opts)
+}
+
+// SearchBuffer is like SearchFile, but fingerprints media loaded in memory.
+func (x *PexSearchClient) SearchBuffer(ctx context.Context, buffer []byte, opts *SearchOptions) (*PexSearchResult, error) {
+	if opts == nil {
+		opts = new(SearchOptions)
+	}
+	typ := x.opts.resolveSearchType(opts.Type)
+
+	ft, err := x.FingerprintBufferWithOptions(ctx, buffer, opts.fingerprintOptions(searchFingerprintTypes(typ)))
+	if err != nil {
+		return nil, err
+	}
+	return x.search(ctx, ft, opts)
+}
+
+func (x *PexSearchClient) search(ctx context.Context, ft *Fingerprint, opts *SearchOptions) (*PexSearchResult, error) {
+	fut, err := x.StartSearchContext(ctx, &PexSearchRequest{
+		Fingerprint: ft,
+		Type:        opts.Type,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer fut.Cancel()
+
+	res, err := fut.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res.ShiftQuery(ft.Offset())
+	res.ContentClassification.shift(ft.Offset())
+	if opts.ReturnFingerprint {
+		res.Fingerprint = ft
+	}
+	return res, nil
+}
+
+// SearchFile is like PexSearchClient.SearchFile, but performs a private
+// search. FingerprintTypeAll is created unless SearchOptions.Types says
+// otherwise.
+func (x *PrivateSearchClient) SearchFile(ctx context.Context, path string, opts *SearchOptions) (*PrivateSearchResult, error) {
+	if opts == nil {
+		opts = new(SearchOptions)
+	}
+
+	ft, err := x.FingerprintFileWithOptions(ctx, path, opts.fingerprintOptions(FingerprintTypeAll))
+	if err != nil {
+		return nil, err
+	}
+	return x.search(ctx, ft, opts)
+}
+
+// SearchBuffer is like SearchFile, but fingerprints media loaded in memory.
+func (x *PrivateSearchClient) SearchBuffer(ctx context.Context, buffer []byte, opts *SearchOptions) (*PrivateSearchResult, error) {
+	if opts == nil {
+		opts = new(SearchOptions)
+	}
+
+	ft, err := x.FingerprintBufferWithOptions(ctx, buffer, opts.fingerprintOptions(FingerprintTypeAll))
+	if err != nil {
+		return nil, err
+	}
+	return x.search(ctx, ft, opts)
+}
+
+func (x *PrivateSearchClient) search(ctx context.Context, ft *Fingerprint, opts *SearchOptions) (*PrivateSearchResult, error) {
+	fut, err := x.StartSearchContext(ctx, &PrivateSearchRequest{
+		Fingerprint: ft,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer fut.Cancel()
+
+	res, err := fut.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res.ShiftQuery(ft.Offset())
+	res.ContentClassification.shift(ft.Offset())
+	if opts.ReturnFingerprint {
+		res.Fingerprint = ft
+	}
+	return res, nil
+}
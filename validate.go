@@ -0,0 +1,123 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// The input is validated before it's passed to the native library, so that
+// invalid input results in an error with StatusInvalidInput rather than in
+// a crash or an obscure error returned from the native library.
+
+func errInvalidInput(format string, args ...any) error {
+	return &Error{
+		Code:    StatusInvalidInput,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func validatePath(path string) error {
+	if path == "" {
+		return errInvalidInput("path must not be empty")
+	}
+	return nil
+}
+
+func validateBuffer(buffer []byte) error {
+	if len(buffer) == 0 {
+		return errInvalidInput("buffer must not be empty")
+	}
+	return nil
+}
+
+func validateFingerprint(ft *Fingerprint) error {
+	if ft == nil {
+		return errInvalidInput("fingerprint must not be nil")
+	}
+	if len(ft.b) == 0 {
+		return errInvalidInput("fingerprint must not be empty")
+	}
+	return nil
+}
+
+func validateTypes(types []FingerprintType) error {
+	for _, t := range types {
+		if t <= 0 || t&^fingerprintTypeKnown != 0 {
+			return errInvalidInput("invalid fingerprint type %d", int(t))
+		}
+	}
+	return nil
+}
+
+func validateID(id string) error {
+	if id == "" {
+		return errInvalidInput("id must not be empty")
+	}
+	return nil
+}
+
+func validateLookupIDs(lookupIDs []string) error {
+	if len(lookupIDs) == 0 {
+		return errInvalidInput("at least one lookup ID is required")
+	}
+	for _, id := range lookupIDs {
+		if id == "" {
+			return errInvalidInput("lookup ID must not be empty")
+		}
+	}
+	return nil
+}
+
+// validateRange checks a time range of media, where zero end means the end
+// of the media.
+func validateRange(start, end time.Duration) error {
+	if start < 0 {
+		return errInvalidInput("start must not be negative, got %v", start)
+	}
+	if end != 0 && end <= start {
+		return errInvalidInput("end (%v) must be after start (%v)", end, start)
+	}
+	return nil
+}
+
+// validatePatterns checks glob patterns, see path.Match.
+func validatePatterns(patterns ...[]string) error {
+	for _, list := range patterns {
+		for _, pattern := range list {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errInvalidInput("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (x *PexSearchRequest) validate() error {
+	if x == nil {
+		return errInvalidInput("request must not be nil")
+	}
+	if x.Type != NativeDefaultSearchType && x.Type < 0 {
+		return errInvalidInput("invalid search type %d", int(x.Type))
+	}
+	return validateFingerprint(x.Fingerprint)
+}
+
+func (x *PrivateSearchRequest) validate() error {
+	if x == nil {
+		return errInvalidInput("request must not be nil")
+	}
+	return validateFingerprint(x.Fingerprint)
+}
+
+func (x *ListEntriesRequest) validate() error {
+	if x == nil {
+		return errInvalidInput("request must not be nil")
+	}
+	if x.Limit < 0 {
+		return errInvalidInput("limit must not be negative, got %d", x.Limit)
+	}
+	return nil
+}
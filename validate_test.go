@@ -0,0 +1,135 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	ft := &Fingerprint{b: []byte{0}}
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{`validatePath("")`, validatePath(""), true},
+		{`validatePath("a.mp4")`, validatePath("a.mp4"), false},
+		{"validateBuffer(nil)", validateBuffer(nil), true},
+		{"validateBuffer([]byte{})", validateBuffer([]byte{}), true},
+		{"validateBuffer([]byte{0})", validateBuffer([]byte{0}), false},
+		{"validateFingerprint(nil)", validateFingerprint(nil), true},
+		{"validateFingerprint(empty)", validateFingerprint(&Fingerprint{}), true},
+		{"validateFingerprint(ft)", validateFingerprint(ft), false},
+		{`validateID("")`, validateID(""), true},
+		{`validateID("a")`, validateID("a"), false},
+		{"PexSearchRequest(nil)", (*PexSearchRequest)(nil).validate(), true},
+		{"PexSearchRequest(-2)", (&PexSearchRequest{Fingerprint: ft, Type: -2}).validate(), true},
+		{"PexSearchRequest(NativeDefaultSearchType)", (&PexSearchRequest{Fingerprint: ft, Type: NativeDefaultSearchType}).validate(), false},
+		{"PexSearchRequest(0)", (&PexSearchRequest{Fingerprint: ft}).validate(), false},
+		{"PexSearchRequest(no fingerprint)", (&PexSearchRequest{}).validate(), true},
+		{"PrivateSearchRequest(nil)", (*PrivateSearchRequest)(nil).validate(), true},
+		{"PrivateSearchRequest(ft)", (&PrivateSearchRequest{Fingerprint: ft}).validate(), false},
+		{"ListEntriesRequest(nil)", (*ListEntriesRequest)(nil).validate(), true},
+		{"ListEntriesRequest(-1)", (&ListEntriesRequest{Limit: -1}).validate(), true},
+		{"ListEntriesRequest(0)", (&ListEntriesRequest{}).validate(), false},
+		{"ListEntriesRequest(100)", (&ListEntriesRequest{Limit: 100}).validate(), false},
+	}
+	for _, tt := range tests {
+		checkValidateError(t, tt.name, tt.err, tt.wantErr)
+	}
+}
+
+func TestValidateTypes(t *testing.T) {
+	tests := []struct {
+		types   []FingerprintType
+		wantErr bool
+	}{
+		{nil, false},
+		{[]FingerprintType{FingerprintTypeAudio}, false},
+		{[]FingerprintType{FingerprintTypeVideo, FingerprintTypeMelody}, false},
+		{[]FingerprintType{fingerprintTypeKnown}, false},
+		{[]FingerprintType{0}, true},
+		{[]FingerprintType{-1}, true},
+		{[]FingerprintType{fingerprintTypeKnown + 1}, true},
+		{[]FingerprintType{FingerprintTypeAudio, FingerprintTypeVideo | 64}, true},
+	}
+	for _, tt := range tests {
+		checkValidateError(t, "validateTypes", validateTypes(tt.types), tt.wantErr)
+	}
+}
+
+func TestValidateLookupIDs(t *testing.T) {
+	tests := []struct {
+		ids     []string
+		wantErr bool
+	}{
+		{nil, true},
+		{[]string{}, true},
+		{[]string{""}, true},
+		{[]string{"a", ""}, true},
+		{[]string{"a"}, false},
+		{[]string{"a", "b"}, false},
+	}
+	for _, tt := range tests {
+		checkValidateError(t, "validateLookupIDs", validateLookupIDs(tt.ids), tt.wantErr)
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	tests := []struct {
+		start, end time.Duration
+		wantErr    bool
+	}{
+		{0, 0, false},
+		{time.Second, 0, false},
+		{0, time.Second, false},
+		{time.Second, 2 * time.Second, false},
+		{-time.Second, 0, true},
+		{-time.Second, time.Second, true},
+		{time.Second, time.Second, true},
+		{2 * time.Second, time.Second, true},
+		{0, -time.Second, true},
+	}
+	for _, tt := range tests {
+		checkValidateError(t, "validateRange", validateRange(tt.start, tt.end), tt.wantErr)
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		wantErr  bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"*.mp4", "dir/*.mp[34]"}, false},
+		{[]string{"["}, true},
+		{[]string{"*.mp4", "a[b-"}, true},
+		{[]string{`\`}, true},
+	}
+	for _, tt := range tests {
+		checkValidateError(t, "validatePatterns", validatePatterns(tt.patterns), tt.wantErr)
+	}
+}
+
+// checkValidateError checks that err is nil, or an *Error with
+// StatusInvalidInput if wantErr is true.
+func checkValidateError(t *testing.T, name string, err error, wantErr bool) {
+	t.Helper()
+
+	if !wantErr {
+		if err != nil {
+			t.Errorf("%s: got error %v", name, err)
+		}
+		return
+	}
+
+	var e *Error
+	if !errors.As(err, &e) || e.Code != StatusInvalidInput {
+		t.Errorf("%s: got error %v, want an error with StatusInvalidInput", name, err)
+	}
+}
@@ -0,0 +1,539 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DefaultFingerprintWorkerCommand is the name of the companion binary
+// started by FingerprintWorkerPool. It can be installed using:
+//
+//	go install github.com/Pexeso/pex-sdk-go/v4/cmd/pex-fingerprint-worker@latest
+const DefaultFingerprintWorkerCommand = "pex-fingerprint-worker"
+
+// How long a worker is given to start and initialize its client before it's
+// killed.
+const workerStartTimeout = time.Minute
+
+// How long a worker is given to exit after its stdin is closed before it's
+// killed.
+const workerExitTimeout = 5 * time.Second
+
+// FingerprintWorkerPoolConfig configures a FingerprintWorkerPool.
+type FingerprintWorkerPoolConfig struct {
+	// Size is the number of worker processes. It defaults to the number of
+	// CPUs.
+	Size int
+
+	// Command is the path to the worker binary. It defaults to
+	// DefaultFingerprintWorkerCommand looked up in the directories listed in
+	// the PATH environment variable.
+	Command string
+
+	// Credentials are passed to the workers, which need to authenticate
+	// their own clients. If nil, the workers read the credentials from the
+	// PEX_CLIENT_ID and PEX_CLIENT_SECRET environment variables.
+	Credentials CredentialsProvider
+
+	// Private makes the workers use a private search client instead of a
+	// Pex search client.
+	Private bool
+}
+
+// FingerprintWorkerPool fingerprints media in a pool of worker processes.
+// Every worker has its own instance of the native library, so unlike the
+// clients, which fingerprint one file at a time within a process, the pool
+// fingerprints up to Size files truly in parallel without blocking the
+// searches performed by the clients in the meantime.
+//
+// When the context of a job is done, the worker processing it is killed.
+// Workers that crash or are killed are restarted automatically when they
+// are needed again.
+type FingerprintWorkerPool struct {
+	cfg  FingerprintWorkerPoolConfig
+	opts *options
+	env  []string
+
+	// slots holds one entry per worker; nil means the worker needs to be
+	// (re)started before it's used.
+	slots chan *fingerprintWorker
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ Fingerprinter = (*FingerprintWorkerPool)(nil)
+
+// NewFingerprintWorkerPool starts a pool of worker processes. It fails if
+// any of the workers can't be started or authenticated. Only the WithLogger,
+// WithReaderMemoryLimit, WithFFmpegPath, WithFingerprintCache,
+// WithSourceMetadata and WithMediaPreflight options apply to the pool.
+func NewFingerprintWorkerPool(ctx context.Context, cfg FingerprintWorkerPoolConfig, opts ...Option) (*FingerprintWorkerPool, error) {
+	if cfg.Size <= 0 {
+		cfg.Size = runtime.NumCPU()
+	}
+	if cfg.Command == "" {
+		cfg.Command = DefaultFingerprintWorkerCommand
+	}
+
+	x := &FingerprintWorkerPool{
+		cfg:    cfg,
+		opts:   newOptions(opts),
+		env:    os.Environ(),
+		slots:  make(chan *fingerprintWorker, cfg.Size),
+		closed: make(chan struct{}),
+	}
+
+	if cfg.Credentials != nil {
+		creds, err := cfg.Credentials.Credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		x.env = append(x.env, "PEX_CLIENT_ID="+creds.ClientID, "PEX_CLIENT_SECRET="+creds.ClientSecret)
+	}
+
+	for i := 0; i < cfg.Size; i++ {
+		w, err := x.startWorker(ctx)
+		if err != nil {
+			// Fill the remaining slots so that Close doesn't block.
+			for ; i < cfg.Size; i++ {
+				x.slots <- nil
+			}
+			x.Close()
+			return nil, err
+		}
+		x.slots <- w
+	}
+	return x, nil
+}
+
+// Close stops all the workers. It waits for the running jobs to finish. All
+// the jobs started afterwards return ErrClientClosed.
+func (x *FingerprintWorkerPool) Close() error {
+	x.closeOnce.Do(func() {
+		close(x.closed)
+		for i := 0; i < x.cfg.Size; i++ {
+			if w := <-x.slots; w != nil {
+				w.stop()
+			}
+		}
+	})
+	return nil
+}
+
+// FingerprintFile is like PexSearchClient.FingerprintFile, but the file is
+// fingerprinted by one of the workers.
+func (x *FingerprintWorkerPool) FingerprintFile(path string, types ...FingerprintType) (*Fingerprint, error) {
+	return x.FingerprintFileContext(context.Background(), path, types...)
+}
+
+// FingerprintFileContext is like FingerprintFile, but kills the worker and
+// returns ctx.Err() as soon as the context is done.
+func (x *FingerprintWorkerPool) FingerprintFileContext(ctx context.Context, path string, types ...FingerprintType) (*Fingerprint, error) {
+	if err := validatePath(path); err != nil {
+		return nil, err
+	}
+	if err := validateTypes(types); err != nil {
+		return nil, err
+	}
+	if err := x.opts.checkMedia([]byte(path), true); err != nil {
+		return nil, err
+	}
+	req := &workerRequest{
+		Path:  path,
+		Types: reduceTypes(types),
+	}
+	return x.fingerprint(ctx, req, []byte(path), true)
+}
+
+// FingerprintBuffer is like PexSearchClient.FingerprintBuffer, but the
+// buffer is fingerprinted by one of the workers.
+func (x *FingerprintWorkerPool) FingerprintBuffer(buffer []byte, types ...FingerprintType) (*Fingerprint, error) {
+	return x.FingerprintBufferContext(context.Background(), buffer, types...)
+}
+
+// FingerprintBufferContext is like FingerprintBuffer, but kills the worker
+// and returns ctx.Err() as soon as the context is done.
+func (x *FingerprintWorkerPool) FingerprintBufferContext(ctx context.Context, buffer []byte, types ...FingerprintType) (*Fingerprint, error) {
+	if err := validateBuffer(buffer); err != nil {
+		return nil, err
+	}
+	if err := validateTypes(types); err != nil {
+		return nil, err
+	}
+	if err := x.opts.checkMedia(buffer, false); err != nil {
+		return nil, err
+	}
+	req := &workerRequest{
+		Buffer: buffer,
+		Types:  reduceTypes(types),
+	}
+	return x.fingerprint(ctx, req, buffer, false)
+}
+
+// FingerprintReader is like PexSearchClient.FingerprintReader, but the media
+// is fingerprinted by one of the workers.
+func (x *FingerprintWorkerPool) FingerprintReader(r io.Reader, size int64, types ...FingerprintType) (*Fingerprint, error) {
+	return x.FingerprintReaderContext(context.Background(), r, size, types...)
+}
+
+// FingerprintReaderContext is like FingerprintReader, but stops reading and
+// returns ctx.Err() as soon as the context is done.
+func (x *FingerprintWorkerPool) FingerprintReaderContext(ctx context.Context, r io.Reader, size int64, types ...FingerprintType) (*Fingerprint, error) {
+	return fingerprintReader(ctx, x, x.opts.readerMemoryLimit, r, size, types)
+}
+
+// FingerprintFileWithOptions is like
+// PexSearchClient.FingerprintFileWithOptions, but the file is fingerprinted
+// by one of the workers.
+func (x *FingerprintWorkerPool) FingerprintFileWithOptions(ctx context.Context, path string, opts FingerprintOptions) (*Fingerprint, error) {
+	return fingerprintFileWithOptions(ctx, x, x.opts.ffmpegPath, path, opts)
+}
+
+// FingerprintBufferWithOptions is like
+// PexSearchClient.FingerprintBufferWithOptions, but the buffer is
+// fingerprinted by one of the workers.
+func (x *FingerprintWorkerPool) FingerprintBufferWithOptions(ctx context.Context, buffer []byte, opts FingerprintOptions) (*Fingerprint, error) {
+	return fingerprintBufferWithOptions(ctx, x, x.opts.ffmpegPath, buffer, opts)
+}
+
+// FingerprintDir is like PexSearchClient.FingerprintDir, but the files are
+// fingerprinted by the workers. The number of workers used by FingerprintDir
+// defaults to the size of the pool.
+func (x *FingerprintWorkerPool) FingerprintDir(ctx context.Context, root string, opts *FingerprintDirOptions) (*FingerprintDirJob, error) {
+	if opts == nil || opts.Workers <= 0 {
+		o := FingerprintDirOptions{}
+		if opts != nil {
+			o = *opts
+		}
+		o.Workers = x.cfg.Size
+		opts = &o
+	}
+	return fingerprintDir(ctx, x, root, opts)
+}
+
+// fingerprint processes the request using the cache, if configured. The
+// media is hashed here, because the cache belongs to this process, not to
+// the workers.
+func (x *FingerprintWorkerPool) fingerprint(ctx context.Context, req *workerRequest, input []byte, isFile bool) (*Fingerprint, error) {
+	if x.opts.cache == nil && !x.opts.sourceMetadata {
+		return x.do(ctx, req)
+	}
+
+	meta := newFingerprintMetadata(req.Types)
+	if err := meta.describeSource(ctx, input, isFile); err != nil {
+		return nil, err
+	}
+	return x.opts.cache.getOrCreate(meta, x.logf, func() (*Fingerprint, error) {
+		ft, err := x.do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		ft.Metadata = meta
+		return ft, nil
+	})
+}
+
+func (x *FingerprintWorkerPool) do(ctx context.Context, req *workerRequest) (*Fingerprint, error) {
+	select {
+	case <-x.closed:
+		return nil, ErrClientClosed
+	default:
+	}
+
+	var w *fingerprintWorker
+	select {
+	case w = <-x.slots:
+	case <-x.closed:
+		return nil, ErrClientClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// The pool might have been closed while waiting for the slot. Close
+	// waits for all the slots, so the slot must be returned.
+	select {
+	case <-x.closed:
+		x.slots <- w
+		return nil, ErrClientClosed
+	default:
+	}
+
+	if w == nil {
+		var err error
+		if w, err = x.startWorker(ctx); err != nil {
+			x.slots <- nil
+			return nil, err
+		}
+	}
+
+	res, err := w.do(ctx, req)
+	if err != nil {
+		// The worker is in an unknown state, e.g. it might still be
+		// processing the request, so it's replaced.
+		w.kill()
+		x.slots <- nil
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		x.logf("fingerprint worker %d failed: %v", w.pid(), err)
+		return nil, &Error{
+			Code:        StatusInternalError,
+			Message:     fmt.Sprintf("fingerprint worker failed: %v", err),
+			IsRetryable: true,
+		}
+	}
+	x.slots <- w
+
+	if res.Code != StatusOK {
+		return nil, &Error{
+			Code:        res.Code,
+			Message:     res.Message,
+			IsRetryable: res.IsRetryable,
+		}
+	}
+	return &Fingerprint{
+		b:        res.Fingerprint,
+		Metadata: res.Metadata,
+	}, nil
+}
+
+func (x *FingerprintWorkerPool) logf(format string, v ...any) {
+	if x.opts.logger != nil {
+		x.opts.logger.Printf("pex: "+format, v...)
+	}
+}
+
+// startWorker starts a worker and waits for it to initialize its client. The
+// worker is killed if that takes longer than workerStartTimeout or if the
+// context is done first.
+func (x *FingerprintWorkerPool) startWorker(ctx context.Context) (*fingerprintWorker, error) {
+	args := []string{}
+	if x.cfg.Private {
+		args = append(args, "-private")
+	}
+
+	cmd := exec.Command(x.cfg.Command, args...)
+	cmd.Env = x.env
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike cmd.StdoutPipe, a pipe created manually isn't closed by
+	// cmd.Wait, which allows to wait for the process concurrently with
+	// reading its output.
+	stdout, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = pw
+
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, fmt.Errorf("failed to start fingerprint worker: %w", err)
+	}
+
+	w := &fingerprintWorker{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		enc:    gob.NewEncoder(stdin),
+		dec:    gob.NewDecoder(stdout),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		close(w.exited)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, workerStartTimeout)
+	defer cancel()
+
+	// The worker reports whether it managed to initialize its client. The
+	// decoding fails once the worker is killed.
+	var hello workerResponse
+	ch := make(chan error, 1)
+	go func() {
+		ch <- w.dec.Decode(&hello)
+	}()
+
+	select {
+	case err = <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		w.kill()
+		return nil, fmt.Errorf("failed to start fingerprint worker: %w", err)
+	}
+	if hello.Code != StatusOK {
+		w.kill()
+		return nil, &Error{
+			Code:    hello.Code,
+			Message: "fingerprint worker failed to initialize: " + hello.Message,
+		}
+	}
+	return w, nil
+}
+
+type workerRequest struct {
+	Path   string
+	Buffer []byte
+	Types  FingerprintType
+}
+
+type workerResponse struct {
+	Fingerprint []byte
+	Metadata    FingerprintMetadata
+	Code        StatusCode
+	Message     string
+	IsRetryable bool
+}
+
+// fingerprintWorker is a single worker process. It processes one request at
+// a time.
+type fingerprintWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	exited chan struct{}
+}
+
+func (x *fingerprintWorker) pid() int {
+	return x.cmd.Process.Pid
+}
+
+func (x *fingerprintWorker) do(ctx context.Context, req *workerRequest) (*workerResponse, error) {
+	ch := make(chan error, 1)
+	res := new(workerResponse)
+
+	go func() {
+		if err := x.enc.Encode(req); err != nil {
+			ch <- err
+			return
+		}
+		ch <- x.dec.Decode(res)
+	}()
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	case <-x.exited:
+		return nil, errors.New("worker exited unexpectedly")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stop asks the worker to exit by closing its stdin and kills it if it
+// doesn't exit in time.
+func (x *fingerprintWorker) stop() {
+	x.stdin.Close()
+	select {
+	case <-x.exited:
+		x.stdout.Close()
+	case <-time.After(workerExitTimeout):
+		x.kill()
+	}
+}
+
+func (x *fingerprintWorker) kill() {
+	x.cmd.Process.Kill()
+	<-x.exited
+	x.stdout.Close()
+}
+
+// ServeFingerprintWorker implements the worker side of FingerprintWorkerPool
+// and is only meant to be used by the companion binary. It creates a client
+// using the credentials from the environment, then reads the requests from r
+// and writes the responses to w until r is closed.
+func ServeFingerprintWorker(ctx context.Context, r io.Reader, w io.Writer, private bool) error {
+	enc := gob.NewEncoder(w)
+	dec := gob.NewDecoder(r)
+
+	var fp interface {
+		Fingerprinter
+		Close() error
+	}
+	var err error
+	if private {
+		fp, err = NewPrivateSearchClientWithCredentials(ctx, EnvCredentials())
+	} else {
+		fp, err = NewPexSearchClientWithCredentials(ctx, EnvCredentials())
+	}
+	if err != nil {
+		enc.Encode(errorToWorkerResponse(err))
+		return err
+	}
+	defer fp.Close()
+
+	if err := enc.Encode(&workerResponse{}); err != nil {
+		return err
+	}
+
+	for {
+		var req workerRequest
+		if err := dec.Decode(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var ft *Fingerprint
+		if req.Path != "" {
+			ft, err = fp.FingerprintFileContext(ctx, req.Path, req.Types)
+		} else {
+			ft, err = fp.FingerprintBufferContext(ctx, req.Buffer, req.Types)
+		}
+
+		res := errorToWorkerResponse(err)
+		if err == nil {
+			res.Fingerprint = ft.Dump()
+			res.Metadata = ft.Metadata
+		}
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+}
+
+func errorToWorkerResponse(err error) *workerResponse {
+	if err == nil {
+		return &workerResponse{}
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return &workerResponse{
+			Code:        e.Code,
+			Message:     e.Message,
+			IsRetryable: e.IsRetryable,
+		}
+	}
+	return &workerResponse{
+		Code:    StatusInternalError,
+		Message: err.Error(),
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Pexeso Inc. All rights reserved.
+
+package pex
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// testWorkerEnv makes the test binary act as a fingerprint worker, see
+// serveTestWorker. Its value selects the behavior of the worker on startup.
+const testWorkerEnv = "PEX_TEST_FINGERPRINT_WORKER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(testWorkerEnv); mode != "" {
+		serveTestWorker(mode)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// serveTestWorker implements the worker side of the protocol without a
+// client. On startup it either reports success ("ok"), reports an error
+// ("fail"), exits ("exit") or hangs ("hang"). The fingerprint of a request
+// is the path or the buffer itself, except for the following paths: "fail"
+// returns an error, "crash" exits the worker and "hang" never responds.
+func serveTestWorker(mode string) {
+	enc := gob.NewEncoder(os.Stdout)
+	dec := gob.NewDecoder(os.Stdin)
+
+	switch mode {
+	case "fail":
+		enc.Encode(&workerResponse{Code: StatusUnauthenticated, Message: "invalid credentials"})
+		os.Exit(1)
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Hour)
+	}
+
+	if err := enc.Encode(&workerResponse{}); err != nil {
+		os.Exit(1)
+	}
+	for {
+		var req workerRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+
+		res := &workerResponse{
+			Fingerprint: req.Buffer,
+			Metadata:    FingerprintMetadata{Types: req.Types},
+		}
+		switch req.Path {
+		case "":
+		case "fail":
+			res = &workerResponse{Code: StatusInvalidInput, Message: "invalid media", IsRetryable: true}
+		case "crash":
+			os.Exit(2)
+		case "hang":
+			time.Sleep(time.Hour)
+		default:
+			res.Fingerprint = []byte(req.Path)
+		}
+		if err := enc.Encode(res); err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+func newTestWorkerPool(t *testing.T, ctx context.Context, mode string) (*FingerprintWorkerPool, error) {
+	t.Helper()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(testWorkerEnv, mode)
+	return NewFingerprintWorkerPool(ctx, FingerprintWorkerPoolConfig{Size: 2, Command: exe})
+}
+
+func TestFingerprintWorkerPool(t *testing.T) {
+	pool, err := newTestWorkerPool(t, context.Background(), "ok")
+	if err != nil {
+		t.Fatalf("NewFingerprintWorkerPool: %v", err)
+	}
+	defer pool.Close()
+
+	ft, err := pool.FingerprintFile("a.mp4", FingerprintTypeAudio)
+	if err != nil || string(ft.Dump()) != "a.mp4" || ft.Metadata.Types != FingerprintTypeAudio {
+		t.Errorf("FingerprintFile = %v, %v, want the fingerprint of a.mp4", ft, err)
+	}
+	ft, err = pool.FingerprintBuffer([]byte("media"))
+	if err != nil || string(ft.Dump()) != "media" || ft.Metadata.Types != FingerprintTypeAll {
+		t.Errorf("FingerprintBuffer = %v, %v, want the fingerprint of the buffer", ft, err)
+	}
+
+	// Errors are passed through and the worker is kept.
+	_, err = pool.FingerprintFile("fail")
+	var e *Error
+	if !errors.As(err, &e) || e.Code != StatusInvalidInput || e.Message != "invalid media" || !e.IsRetryable {
+		t.Errorf("FingerprintFile(\"fail\"): got error %v, want the error of the worker", err)
+	}
+}
+
+func TestFingerprintWorkerPoolRestart(t *testing.T) {
+	pool, err := newTestWorkerPool(t, context.Background(), "ok")
+	if err != nil {
+		t.Fatalf("NewFingerprintWorkerPool: %v", err)
+	}
+	defer pool.Close()
+
+	// Crashed and killed workers are replaced, even when all of them are
+	// gone.
+	for i := 0; i < 3; i++ {
+		_, err := pool.FingerprintFile("crash")
+		var e *Error
+		if !errors.As(err, &e) || e.Code != StatusInternalError || !e.IsRetryable {
+			t.Errorf("FingerprintFile(\"crash\"): got error %v, want a retryable internal error", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if _, err := pool.FingerprintFileContext(ctx, "hang"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("FingerprintFileContext(\"hang\"): got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if ft, err := pool.FingerprintFile("a.mp4"); err != nil || string(ft.Dump()) != "a.mp4" {
+			t.Errorf("FingerprintFile after a restart = %v, %v", ft, err)
+		}
+	}
+}
+
+func TestFingerprintWorkerPoolStartFailure(t *testing.T) {
+	_, err := newTestWorkerPool(t, context.Background(), "fail")
+	var e *Error
+	if !errors.As(err, &e) || e.Code != StatusUnauthenticated {
+		t.Errorf("failing worker: got error %v, want the error of the worker", err)
+	}
+
+	if _, err := newTestWorkerPool(t, context.Background(), "exit"); err == nil {
+		t.Error("exiting worker: got no error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := newTestWorkerPool(t, ctx, "hang"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("hanging worker: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("hanging worker: took %v to fail", elapsed)
+	}
+}
+
+func TestFingerprintWorkerPoolClose(t *testing.T) {
+	pool, err := newTestWorkerPool(t, context.Background(), "ok")
+	if err != nil {
+		t.Fatalf("NewFingerprintWorkerPool: %v", err)
+	}
+
+	// A request waiting for a worker fails once the pool is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		go pool.FingerprintFileContext(ctx, "hang")
+	}
+	for len(pool.slots) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiting := make(chan error)
+	go func() {
+		_, err := pool.FingerprintFile("a.mp4")
+		waiting <- err
+	}()
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	if err := <-waiting; err != ErrClientClosed {
+		t.Errorf("waiting request: got error %v, want %v", err, ErrClientClosed)
+	}
+
+	// Close waits for the running jobs.
+	cancel()
+	<-closed
+
+	if _, err := pool.FingerprintFile("a.mp4"); err != ErrClientClosed {
+		t.Errorf("after Close: got error %v, want %v", err, ErrClientClosed)
+	}
+}
+
+func TestErrorToWorkerResponse(t *testing.T) {
+	tests := []struct {
+		err  error
+		want workerResponse
+	}{
+		{nil, workerResponse{}},
+		{&Error{Code: StatusNotFound, Message: "missing", IsRetryable: true}, workerResponse{Code: StatusNotFound, Message: "missing", IsRetryable: true}},
+		{errors.New("other"), workerResponse{Code: StatusInternalError, Message: "other"}},
+	}
+	for _, tt := range tests {
+		got := errorToWorkerResponse(tt.err)
+		if got.Code != tt.want.Code || got.Message != tt.want.Message || got.IsRetryable != tt.want.IsRetryable {
+			t.Errorf("errorToWorkerResponse(%v) = %+v, want %+v", tt.err, got, tt.want)
+		}
+	}
+}